@@ -0,0 +1,205 @@
+package adapterpostgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/jackc/pgx/v5"
+)
+
+/// Postgres doesn't have an update hook like sqlite, instead tracked tables get a trigger that
+/// publishes each change with `pg_notify` and a dedicated connection `LISTEN` to them.
+/// Notifications are only delivered once the transaction commits.
+
+const changesChannel = "sqltoolbox_changes"
+
+// `pg_notify` payloads are limited to 8000 bytes, the row images are dropped when the row is too large
+var notifyFunction = `
+CREATE OR REPLACE FUNCTION sqltoolbox_notify_change() RETURNS trigger AS $$
+DECLARE
+	row_key TEXT;
+	before_image JSONB;
+	after_image JSONB;
+	payload TEXT;
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		before_image := to_jsonb(OLD);
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		after_image := to_jsonb(NEW);
+	END IF;
+	row_key := COALESCE(after_image, before_image)->>'id';
+	payload := json_build_object(
+		'op', lower(TG_OP),
+		'schema', TG_TABLE_SCHEMA,
+		'table', TG_TABLE_NAME,
+		'rowid', row_key,
+		'before', before_image,
+		'after', after_image
+	)::text;
+	IF octet_length(payload) > 7900 THEN
+		payload := json_build_object(
+			'op', lower(TG_OP),
+			'schema', TG_TABLE_SCHEMA,
+			'table', TG_TABLE_NAME,
+			'rowid', row_key
+		)::text;
+	END IF;
+	PERFORM pg_notify('` + changesChannel + `', payload);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+// TrackTable installs the trigger publishing the changes of a table, the table must already exist.
+// Requires the connector to be created with `DBWithChangeEvents` for the middlewares to receive them.
+func TrackTable(muxdb *data.MuxDb, table string) error {
+	return muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+
+		trigger := pgx.Identifier{"sqltoolbox_" + table + "_changes"}.Sanitize()
+		target := pgx.Identifier{table}.Sanitize()
+
+		for _, statement := range []string{
+			notifyFunction,
+			fmt.Sprintf(`DROP TRIGGER IF EXISTS %v ON %v;`, trigger, target),
+			fmt.Sprintf(`CREATE TRIGGER %v AFTER INSERT OR UPDATE OR DELETE ON %v FOR EACH ROW EXECUTE FUNCTION sqltoolbox_notify_change();`, trigger, target),
+		} {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+}
+
+type changePayload struct {
+	Op     string         `json:"op"`
+	Schema string         `json:"schema"`
+	Table  string         `json:"table"`
+	RowID  *string        `json:"rowid"`
+	Before map[string]any `json:"before"`
+	After  map[string]any `json:"after"`
+}
+
+type listener struct {
+	config            *pgx.ConnConfig
+	middlewareManager *data.MiddlewareManager
+	muxdb             *data.MuxDb
+	cancel            context.CancelFunc
+	done              chan struct{}
+}
+
+func (l *listener) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		for {
+			if err := l.listen(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("postgres listener failed, reconnecting", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+func (l *listener) stop() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
+
+func (l *listener) listen(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, l.config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		event, err := decodeChange(notification.Payload)
+		if err != nil {
+			slog.Error("invalid change notification", slog.Any("payload", notification.Payload), slog.Any("error", err))
+			continue
+		}
+		event.Reader = l.muxdb
+
+		if !l.middlewareManager.Subscribed(event.Table, event.Op) {
+			continue
+		}
+
+		// notifications are only sent once the transaction committed
+		l.middlewareManager.Dispatch([]data.ChangeEvent{event})
+	}
+}
+
+// decodeChange turns the payload published by the trigger into the event of the change
+func decodeChange(notification string) (data.ChangeEvent, error) {
+	var payload changePayload
+	decoder := json.NewDecoder(strings.NewReader(notification))
+	// keep the precision of the integers, our timestamps are in nanoseconds
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return data.ChangeEvent{}, err
+	}
+
+	event := data.ChangeEvent{
+		Op:     data.Operation(payload.Op),
+		Schema: payload.Schema,
+		Table:  payload.Table,
+		Before: numbers(payload.Before),
+		After:  numbers(payload.After),
+	}
+	if payload.RowID != nil {
+		// non numerical keys are only available as text
+		event.Key = *payload.RowID
+		event.RowID, _ = strconv.ParseInt(*payload.RowID, 10, 64)
+	}
+	return event, nil
+}
+
+// Turn the `json.Number` of a row image back into `int64` or `float64`
+func numbers(row map[string]any) map[string]any {
+	for key, value := range row {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if integer, err := number.Int64(); err == nil {
+			row[key] = integer
+		} else if float, err := number.Float64(); err == nil {
+			row[key] = float
+		}
+	}
+	return row
+}
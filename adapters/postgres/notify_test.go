@@ -0,0 +1,96 @@
+package adapterpostgres
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/data/datatest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the postgres statements")
+
+// The trigger installed on a tracked table, `go test -run TestTrackTable -update` rewrites it
+func TestTrackTable(t *testing.T) {
+	recorder := datatest.NewRecorder(data.Postgres)
+
+	if err := TrackTable(recorder.MuxDb(), "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.Golden(t, "testdata/track_table.golden", *update)
+}
+
+func TestDecodeChange(t *testing.T) {
+	cases := []struct {
+		name         string
+		notification string
+		expected     data.ChangeEvent
+	}{
+		{
+			name:         "update",
+			notification: `{"op":"update","schema":"public","table":"orders","rowid":"42","before":{"id":42,"status":"enqueued","created_at":1760000000123456789},"after":{"id":42,"status":"completed","created_at":1760000000123456789,"total":12.5}}`,
+			expected: data.ChangeEvent{
+				Op:     data.Update,
+				Schema: "public",
+				Table:  "orders",
+				RowID:  42,
+				Key:    "42",
+				Before: map[string]any{"id": int64(42), "status": "enqueued", "created_at": int64(1760000000123456789)},
+				After:  map[string]any{"id": int64(42), "status": "completed", "created_at": int64(1760000000123456789), "total": 12.5},
+			},
+		},
+		{
+			name:         "insert",
+			notification: `{"op":"insert","schema":"public","table":"orders","rowid":"7","before":null,"after":{"id":7}}`,
+			expected: data.ChangeEvent{
+				Op:     data.Insert,
+				Schema: "public",
+				Table:  "orders",
+				RowID:  7,
+				Key:    "7",
+				After:  map[string]any{"id": int64(7)},
+			},
+		},
+		{
+			// the trigger drops the images of the rows too large for `pg_notify`
+			name:         "without images",
+			notification: `{"op":"delete","schema":"public","table":"orders","rowid":"9"}`,
+			expected: data.ChangeEvent{
+				Op:     data.Delete,
+				Schema: "public",
+				Table:  "orders",
+				RowID:  9,
+				Key:    "9",
+			},
+		},
+		{
+			name:         "non numerical key",
+			notification: `{"op":"insert","schema":"public","table":"tags","rowid":"go","after":{"id":"go"}}`,
+			expected: data.ChangeEvent{
+				Op:     data.Insert,
+				Schema: "public",
+				Table:  "tags",
+				Key:    "go",
+				After:  map[string]any{"id": "go"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			event, err := decodeChange(c.notification)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(event, c.expected) {
+				t.Errorf("expected %#v, got %#v", c.expected, event)
+			}
+		})
+	}
+
+	if _, err := decodeChange(`not json`); err == nil {
+		t.Error("expected an invalid notification to be refused")
+	}
+}
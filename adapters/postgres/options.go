@@ -0,0 +1,197 @@
+package adapterpostgres
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+)
+
+// Configuration for the database connection
+type dbConfig struct {
+	dsn        string
+	host       data.Option[dbHost]
+	user       string
+	password   string
+	database   string
+	sslMode    data.Option[dbSSLMode]
+	searchPath data.Option[dbSearchPath]
+	pool       poolConfig
+	// listen to the changes of the tables tracked with `TrackTable`
+	changeEvents bool
+}
+
+// Sizing of the `database/sql` pool, zero values keep the `database/sql` defaults
+type poolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+}
+
+type PostgresOption func(*dbConfig)
+
+// Use a complete DSN, either as an url (`postgres://...`) or as `key=value` pairs.
+// Host, user, password and database options are ignored when a DSN is provided.
+func DBWithDSN(dsn string) PostgresOption {
+	return func(config *dbConfig) {
+		config.dsn = dsn
+	}
+}
+
+func DBWithHost(host string, port int) PostgresOption {
+	return func(config *dbConfig) {
+		config.host.Enable(dbHost{host: host, port: port})
+	}
+}
+
+func DBWithUser(user string, password string) PostgresOption {
+	return func(config *dbConfig) {
+		config.user = user
+		config.password = password
+	}
+}
+
+func DBWithDatabase(name string) PostgresOption {
+	return func(config *dbConfig) {
+		config.database = name
+	}
+}
+
+// TLS mode of the connection
+func DBWithSSLMode(value dbSSLMode) PostgresOption {
+	return func(config *dbConfig) {
+		config.sslMode.Enable(value)
+	}
+}
+
+// Schemas searched for unqualified names, the middlewares tables will be created in the first one
+func DBWithSearchPath(schemas ...string) PostgresOption {
+	return func(config *dbConfig) {
+		config.searchPath.Enable(dbSearchPath(schemas))
+	}
+}
+
+func DBWithMaxOpenConns(value int) PostgresOption {
+	return func(config *dbConfig) {
+		config.pool.maxOpenConns = value
+	}
+}
+
+func DBWithMaxIdleConns(value int) PostgresOption {
+	return func(config *dbConfig) {
+		config.pool.maxIdleConns = value
+	}
+}
+
+func DBWithConnMaxLifetime(value time.Duration) PostgresOption {
+	return func(config *dbConfig) {
+		config.pool.connMaxLifetime = value
+	}
+}
+
+func DBWithConnMaxIdleTime(value time.Duration) PostgresOption {
+	return func(config *dbConfig) {
+		config.pool.connMaxIdleTime = value
+	}
+}
+
+// Deliver the changes of the tables tracked with `TrackTable` to the middlewares, uses one extra connection
+func DBWithChangeEvents() PostgresOption {
+	return func(config *dbConfig) {
+		config.changeEvents = true
+	}
+}
+
+// `Local` profile options, a server running on the same machine without TLS
+func WithLocal(database string) []PostgresOption {
+	opts := []PostgresOption{
+		DBWithHost("localhost", 5432),
+		DBWithUser("postgres", "postgres"),
+		DBWithDatabase(database),
+		DBWithSSLMode(Disable),
+	}
+	return opts
+}
+
+// Supposed easy configuration through dependency injection
+func NewSettingConfig(options ...PostgresOption) *dbConfig {
+	// with defaults
+	config := &dbConfig{
+		host: data.Option[dbHost]{
+			Env:     "DB_HOST",
+			Enabled: true,
+			Value:   dbHost{host: "localhost", port: 5432},
+		},
+		sslMode: data.Option[dbSSLMode]{
+			Env:     "DB_SSLMODE",
+			Enabled: false,
+			Value:   Prefer,
+		},
+		searchPath: data.Option[dbSearchPath]{
+			Env:     "DB_SEARCH_PATH",
+			Enabled: false,
+			Value:   dbSearchPath{},
+		},
+	}
+	for _, option := range options {
+		option(config)
+	}
+	return config
+}
+
+func ConnectionString(config *dbConfig) (string, error) {
+
+	params := url.Values{}
+
+	if value := config.sslMode.String(); value != "" {
+		params.Set("sslmode", value)
+	}
+	if value := config.searchPath.String(); value != "" {
+		params.Set("search_path", value)
+	}
+
+	if config.dsn != "" {
+		// `key=value` form
+		if !strings.HasPrefix(config.dsn, "postgres://") && !strings.HasPrefix(config.dsn, "postgresql://") {
+			dsn := config.dsn
+			for _, key := range []string{"sslmode", "search_path"} {
+				if value := params.Get(key); value != "" {
+					dsn += fmt.Sprintf(" %v='%v'", key, strings.ReplaceAll(value, "'", `\'`))
+				}
+			}
+			return dsn, nil
+		}
+
+		// url form, the options are overriding the query of the DSN
+		dsn, err := url.Parse(config.dsn)
+		if err != nil {
+			return "", err
+		}
+		query := dsn.Query()
+		for key := range params {
+			query.Set(key, params.Get(key))
+		}
+		dsn.RawQuery = query.Encode()
+		return dsn.String(), nil
+	}
+
+	// postgres://{user}:{password}@{host}:{port}/{database}?{key}={value}&
+	dsn := url.URL{
+		Scheme:   "postgres",
+		Host:     config.host.String(),
+		Path:     "/" + config.database,
+		RawQuery: params.Encode(),
+	}
+	if config.user != "" {
+		if config.password != "" {
+			dsn.User = url.UserPassword(config.user, config.password)
+		} else {
+			dsn.User = url.User(config.user)
+		}
+	}
+
+	return dsn.String(), nil
+}
@@ -0,0 +1,53 @@
+package adapterpostgres
+
+import (
+	"fmt"
+	"strings"
+)
+
+// type to manage the `sslmode` key in the connection string
+type dbSSLMode string
+
+const (
+	Disable    dbSSLMode = "disable"
+	Allow      dbSSLMode = "allow"
+	Prefer     dbSSLMode = "prefer"
+	Require    dbSSLMode = "require"
+	VerifyCA   dbSSLMode = "verify-ca"
+	VerifyFull dbSSLMode = "verify-full"
+)
+
+func (v dbSSLMode) String(env string) string {
+	if env != "" {
+		return env
+	}
+	switch v {
+	case Disable, Allow, Prefer, Require, VerifyCA, VerifyFull:
+		return string(v)
+	default:
+		return "sslmode:unknown"
+	}
+}
+
+// type to manage the `search_path` key in the connection string
+type dbSearchPath []string
+
+func (v dbSearchPath) String(env string) string {
+	if env != "" {
+		return env
+	}
+	return strings.Join(v, ",")
+}
+
+// type to manage the host and port of the server
+type dbHost struct {
+	host string
+	port int
+}
+
+func (v dbHost) String(env string) string {
+	if env != "" {
+		return env
+	}
+	return fmt.Sprintf("%v:%v", v.host, v.port)
+}
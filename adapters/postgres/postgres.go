@@ -0,0 +1,69 @@
+package adapterpostgres
+
+import (
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+type PostgresConnector struct {
+	config   *dbConfig
+	listener *listener
+}
+
+func NewPostgresConnector(opts ...PostgresOption) *PostgresConnector {
+	connector := &PostgresConnector{
+		config:   NewSettingConfig(opts...),
+		listener: &listener{},
+	}
+
+	return connector
+}
+
+func (c PostgresConnector) Open(middlewareManager *data.MiddlewareManager) (*data.MuxDb, error) {
+
+	var connectionString string
+	var err error
+
+	if connectionString, err = ConnectionString(c.config); err != nil {
+		return nil, err
+	}
+
+	var connConfig *pgx.ConnConfig
+	if connConfig, err = pgx.ParseConfig(connectionString); err != nil {
+		return nil, err
+	}
+
+	// no need to register a driver name globally, each toolbox gets its own pool
+	db := stdlib.OpenDB(*connConfig)
+
+	if c.config.pool.maxOpenConns > 0 {
+		db.SetMaxOpenConns(c.config.pool.maxOpenConns)
+	}
+	if c.config.pool.maxIdleConns > 0 {
+		db.SetMaxIdleConns(c.config.pool.maxIdleConns)
+	}
+	if c.config.pool.connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.config.pool.connMaxLifetime)
+	}
+	if c.config.pool.connMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(c.config.pool.connMaxIdleTime)
+	}
+
+	muxdb := data.NewMuxDb(db, data.WithDialect(data.Postgres))
+
+	if c.config.changeEvents {
+		c.listener.config = connConfig
+		c.listener.middlewareManager = middlewareManager
+		c.listener.muxdb = muxdb
+		c.listener.start()
+	}
+
+	return muxdb, nil
+}
+
+func (c PostgresConnector) Close() error {
+	c.listener.stop()
+	// the server owns the data, nothing else to clean up
+	return nil
+}
@@ -0,0 +1,234 @@
+package adaptersqlite3
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/mattn/go-sqlite3"
+)
+
+/// The hooks of sqlite run while the transaction commits, the commit can still fail after them.
+/// The changes are only buffered there, the connection hands them to the middlewares once the call
+/// that committed them (`Commit`, or the statement itself in autocommit) returned without error.
+
+// Changes captured on one connection, a connection is only used by one goroutine at a time
+type connChanges struct {
+	middlewareManager *data.MiddlewareManager
+	capture           *imageCapture
+	// changes of the current transaction
+	buffer []change
+	// changes whose transaction reached its commit, waiting for the commit to succeed
+	committed []change
+}
+
+type change struct {
+	event data.ChangeEvent
+	image rowImage
+}
+
+// hook registers the hooks of a new connection and wraps it so its changes are delivered after their commit
+func hook(conn *sqlite3.SQLiteConn, middlewareManager *data.MiddlewareManager, reader data.RowReader) driver.Conn {
+	changes := &connChanges{
+		middlewareManager: middlewareManager,
+		capture:           newImageCapture(conn, middlewareManager),
+	}
+	changes.capture.register()
+
+	conn.RegisterUpdateHook(
+		func(op int, db string, table string, rowid int64) {
+
+			event := data.ChangeEvent{
+				Schema: db,
+				Table:  table,
+				RowID:  rowid,
+				Key:    strconv.FormatInt(rowid, 10),
+				Reader: reader,
+			}
+
+			switch op {
+			case sqlite3.SQLITE_INSERT:
+				event.Op = data.Insert
+			case sqlite3.SQLITE_UPDATE:
+				event.Op = data.Update
+			case sqlite3.SQLITE_DELETE:
+				event.Op = data.Delete
+			default:
+				return
+			}
+
+			if !middlewareManager.Subscribed(table, event.Op) {
+				return
+			}
+
+			changes.buffer = append(changes.buffer, change{event: event, image: changes.capture.take(event)})
+		},
+	)
+
+	// Called for explicit transactions and autocommit statements alike, right before the commit
+	conn.RegisterCommitHook(func() int {
+		changes.committed = append(changes.committed, changes.buffer...)
+		changes.buffer = nil
+		changes.capture.reset()
+		// non-zero would turn the commit into a rollback
+		return 0
+	})
+
+	conn.RegisterRollbackHook(func() {
+		changes.buffer = nil
+		changes.capture.reset()
+	})
+
+	return &hookedConn{SQLiteConn: conn, changes: changes}
+}
+
+// flush delivers the committed changes when the call that committed them succeeded, and drops them otherwise
+func (c *connChanges) flush(err error) {
+	committed := c.committed
+	c.committed = nil
+	if err != nil || len(committed) == 0 {
+		return
+	}
+	events := make([]data.ChangeEvent, 0, len(committed))
+	for _, change := range committed {
+		c.capture.name(&change.event, change.image)
+		events = append(events, change.event)
+	}
+	c.middlewareManager.Dispatch(events)
+}
+
+func (c *connChanges) drop() {
+	c.buffer = nil
+	c.committed = nil
+}
+
+type hookedConn struct {
+	*sqlite3.SQLiteConn
+	changes *connChanges
+}
+
+func (c *hookedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	c.changes.flush(err)
+	return result, err
+}
+
+func (c *hookedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	result, err := c.SQLiteConn.Exec(query, args)
+	c.changes.flush(err)
+	return result, err
+}
+
+func (c *hookedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	return c.changes.rows(rows, err)
+}
+
+func (c *hookedConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	rows, err := c.SQLiteConn.Query(query, args)
+	return c.changes.rows(rows, err)
+}
+
+func (c *hookedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	return c.changes.stmt(stmt, err)
+}
+
+func (c *hookedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.Prepare(query)
+	return c.changes.stmt(stmt, err)
+}
+
+func (c *hookedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedTx{Tx: tx, changes: c.changes}, nil
+}
+
+func (c *hookedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+type hookedTx struct {
+	driver.Tx
+	changes *connChanges
+}
+
+func (tx *hookedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.changes.flush(err)
+	return err
+}
+
+func (tx *hookedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.changes.drop()
+	return err
+}
+
+func (c *connChanges) stmt(stmt driver.Stmt, err error) (driver.Stmt, error) {
+	if err != nil {
+		return nil, err
+	}
+	sqliteStmt, ok := stmt.(*sqlite3.SQLiteStmt)
+	if !ok {
+		return stmt, nil
+	}
+	return &hookedStmt{SQLiteStmt: sqliteStmt, changes: c}, nil
+}
+
+// rows delays the delivery of an autocommit statement returning rows (e.g. `INSERT ... RETURNING`) until they are closed,
+// sqlite only commits it once it ran to completion
+func (c *connChanges) rows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		c.flush(err)
+		return nil, err
+	}
+	sqliteRows, ok := rows.(*sqlite3.SQLiteRows)
+	if !ok {
+		c.flush(nil)
+		return rows, nil
+	}
+	return &hookedRows{SQLiteRows: sqliteRows, changes: c}, nil
+}
+
+type hookedStmt struct {
+	*sqlite3.SQLiteStmt
+	changes *connChanges
+}
+
+func (s *hookedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	result, err := s.SQLiteStmt.ExecContext(ctx, args)
+	s.changes.flush(err)
+	return result, err
+}
+
+func (s *hookedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.SQLiteStmt.Exec(args)
+	s.changes.flush(err)
+	return result, err
+}
+
+func (s *hookedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	return s.changes.rows(rows, err)
+}
+
+func (s *hookedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.SQLiteStmt.Query(args)
+	return s.changes.rows(rows, err)
+}
+
+type hookedRows struct {
+	*sqlite3.SQLiteRows
+	changes *connChanges
+}
+
+func (r *hookedRows) Close() error {
+	err := r.SQLiteRows.Close()
+	r.changes.flush(err)
+	return err
+}
@@ -0,0 +1,150 @@
+package adaptersqlite3
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/mattn/go-sqlite3"
+)
+
+/// Row images are captured so the middlewares don't have to query the row back themselves.
+/// With the `sqlite_preupdate_hook` build tag we get both the old and the new values from the preupdate hook.
+/// Sqlite forbids queries from within the hooks of the connection, so the values are only named with the columns
+/// of their table once the commit returned, see `conn.go`.
+/// Without it we can only read the new row, it is read through the database right before the event is delivered.
+
+type column struct {
+	name     string
+	declType string
+}
+
+// Values read from sqlite are `[]byte` for both TEXT and BLOB, the declared type tells us which one it was
+func (c column) value(v any) any {
+	raw, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	declType := strings.ToUpper(c.declType)
+	if declType == "" || strings.Contains(declType, "BLOB") {
+		return raw
+	}
+	return string(raw)
+}
+
+// Per connection state shared by the hooks
+type imageCapture struct {
+	conn              *sqlite3.SQLiteConn
+	middlewareManager *data.MiddlewareManager
+	// `schema.table` -> columns, refreshed when the amount of columns changed (ALTER TABLE)
+	columns map[string][]column
+	// images captured by the preupdate hook waiting for the update hook
+	pending map[imageKey]rowImage
+}
+
+type imageKey struct {
+	schema string
+	table  string
+	rowid  int64
+}
+
+// Values of the row in the order of the columns of its table, nil when not captured
+type rowImage struct {
+	before []any
+	after  []any
+}
+
+func newImageCapture(conn *sqlite3.SQLiteConn, middlewareManager *data.MiddlewareManager) *imageCapture {
+	return &imageCapture{
+		conn:              conn,
+		middlewareManager: middlewareManager,
+		columns:           map[string][]column{},
+		pending:           map[imageKey]rowImage{},
+	}
+}
+
+// Images that never reached the update hook (e.g. `WITHOUT ROWID` tables) are dropped with the transaction
+func (c *imageCapture) reset() {
+	if len(c.pending) > 0 {
+		c.pending = map[imageKey]rowImage{}
+	}
+}
+
+// tableColumns reads the columns of a table from the connection, never from within its hooks
+func (c *imageCapture) tableColumns(schema string, table string, count int) ([]column, error) {
+	key := schema + "." + table
+	if columns, ok := c.columns[key]; ok && len(columns) == count {
+		return columns, nil
+	}
+
+	result, err := connReader{conn: c.conn}.Query(fmt.Sprintf(`PRAGMA %v.table_info(%v)`, quoteIdentifier(schema), quoteIdentifier(table)))
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]column, 0, len(result))
+	for _, row := range result {
+		name, _ := row["name"].(string)
+		declType, _ := row["type"].(string)
+		columns = append(columns, column{name: name, declType: declType})
+	}
+	c.columns[key] = columns
+
+	return columns, nil
+}
+
+func (c *imageCapture) toMap(columns []column, values []any) map[string]any {
+	if values == nil {
+		return nil
+	}
+	row := make(map[string]any, len(columns))
+	for i, col := range columns {
+		if i < len(values) {
+			row[col.name] = col.value(values[i])
+		}
+	}
+	return row
+}
+
+// take returns the image captured by the preupdate hook for the event
+func (c *imageCapture) take(event data.ChangeEvent) rowImage {
+	key := imageKey{schema: event.Schema, table: event.Table, rowid: event.RowID}
+	image := c.pending[key]
+	delete(c.pending, key)
+	return image
+}
+
+// name attaches the image to its event with the columns of the table, once out of the hooks.
+// The columns are the ones of the table at that time, a column dropped in the same transaction shifts the values.
+func (c *imageCapture) name(event *data.ChangeEvent, image rowImage) {
+	count := max(len(image.before), len(image.after))
+	if count == 0 {
+		return
+	}
+	columns, err := c.tableColumns(event.Schema, event.Table, count)
+	if err != nil {
+		slog.Error("failed to read the columns of the row image", slog.Any("table", event.Table), slog.Any("error", err))
+		return
+	}
+	event.Before = c.toMap(columns, image.before)
+	event.After = c.toMap(columns, image.after)
+}
+
+// Reads the new row of an event once its transaction committed, the row might have changed again since then
+func afterImage(muxdb *data.MuxDb) data.ImageLoader {
+	return func(event data.ChangeEvent) (map[string]any, error) {
+		result, err := muxdb.Query(
+			fmt.Sprintf(`SELECT * FROM %v.%v WHERE rowid = ?`, quoteIdentifier(event.Schema), quoteIdentifier(event.Table)),
+			event.RowID,
+		)
+		if err != nil || len(result) == 0 {
+			return nil, err
+		}
+		return result[0], nil
+	}
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
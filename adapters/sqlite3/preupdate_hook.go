@@ -0,0 +1,46 @@
+//go:build sqlite_preupdate_hook
+
+package adaptersqlite3
+
+import (
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/mattn/go-sqlite3"
+)
+
+const preUpdateHookEnabled = true
+
+func (c *imageCapture) register() {
+	c.conn.RegisterPreUpdateHook(func(d sqlite3.SQLitePreUpdateData) {
+		op := data.Update
+		switch d.Op {
+		case sqlite3.SQLITE_INSERT:
+			op = data.Insert
+		case sqlite3.SQLITE_DELETE:
+			op = data.Delete
+		}
+		if !c.middlewareManager.Subscribed(d.TableName, op) {
+			return
+		}
+
+		// the values are named once out of the hooks, reading the columns here would query the connection
+		image := rowImage{}
+		rowid := d.NewRowID
+
+		if d.Op != sqlite3.SQLITE_INSERT {
+			values := make([]any, d.Count())
+			if err := d.Old(values...); err == nil {
+				image.before = values
+			}
+		}
+		if d.Op != sqlite3.SQLITE_DELETE {
+			values := make([]any, d.Count())
+			if err := d.New(values...); err == nil {
+				image.after = values
+			}
+		} else {
+			rowid = d.OldRowID
+		}
+
+		c.pending[imageKey{schema: d.DatabaseName, table: d.TableName, rowid: rowid}] = image
+	})
+}
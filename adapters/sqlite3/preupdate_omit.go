@@ -0,0 +1,8 @@
+//go:build !sqlite_preupdate_hook
+
+package adaptersqlite3
+
+const preUpdateHookEnabled = false
+
+// The preupdate hook is only compiled by `go-sqlite3` with the `sqlite_preupdate_hook` build tag
+func (c *imageCapture) register() {}
@@ -0,0 +1,29 @@
+package adaptersqlite3
+
+import (
+	"database/sql/driver"
+
+	"github.com/davidroman0O/sql-toolbox/rows"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Reads from the connection that triggered the hook, going through `database/sql` would
+// wait for the very same connection and dead lock.
+type connReader struct {
+	conn *sqlite3.SQLiteConn
+}
+
+func (r connReader) Query(query string, args ...any) ([]map[string]any, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+
+	iterator, err := r.conn.Query(query, values)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	return rows.GetRowsMap(iterator.Next, rows.WithColumns(iterator.Columns()))
+}
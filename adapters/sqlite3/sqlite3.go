@@ -1,7 +1,9 @@
 package adaptersqlite3
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"log/slog"
 	"os"
 
@@ -44,52 +46,50 @@ func (c Sqlite3Connector) Open(middlewareManager *data.MiddlewareManager) (*data
 
 	slog.Info(connectionString)
 
-	sql.Register(
-		c.config.name,
-		&sqlite3.SQLiteDriver{
-			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-				// register callback
-				conn.RegisterUpdateHook(
-					func(op int, db string, table string, rowid int64) {
+	sqliteDriver := &sqlite3.SQLiteDriver{}
 
-						// TODO @droman: i need a tool to unmarshall the rows from `conn` to have match the sql.DB api
-
-						switch op {
+	// `sql.Register` panics when the same name is registered twice, which happens as soon as
+	// two toolboxes are created in the same process, so we open the database from a connector instead
+	connector := &sqlite3Connector{
+		driver:            sqliteDriver,
+		dsn:               connectionString,
+		middlewareManager: middlewareManager,
+	}
+	db = sql.OpenDB(connector)
 
-						case sqlite3.SQLITE_INSERT:
-							if err := middlewareManager.RunOnInsert(conn, db, table, rowid); err != nil {
-								// TODO: Handle error - i have no idea how
-								slog.Error("SQLITE_INSERT error: %v", err)
-							}
+	// TODO @droman: might only enable that for `memory` mode?
+	db.SetMaxOpenConns(1)
+	// db.SetMaxIdleConns(1)
 
-						case sqlite3.SQLITE_UPDATE:
-							if err := middlewareManager.RunOnUpdate(conn, db, table, rowid); err != nil {
-								// TODO: Handle error - i have no idea how
-								slog.Error("SQLITE_UPDATE error: %v", err)
-							}
+	muxdb := data.NewMuxDb(db)
+	// the connections are opened lazily, once the database exists for their change events to read through
+	connector.reader = muxdb
 
-						case sqlite3.SQLITE_DELETE:
-							if err := middlewareManager.RunOnDelete(conn, db, table, rowid); err != nil {
-								// TODO: Handle error - i have no idea how
-								slog.Error("SQLITE_DELETE error: %v", err)
-							}
+	if !preUpdateHookEnabled {
+		middlewareManager.ImageLoader = afterImage(muxdb)
+	}
 
-						}
-					},
-				)
+	return muxdb, nil
+}
 
-				return nil
-			}})
+// Bind the connection string to the driver without registering it globally, each connection gets the change hooks
+type sqlite3Connector struct {
+	driver            *sqlite3.SQLiteDriver
+	dsn               string
+	middlewareManager *data.MiddlewareManager
+	reader            data.RowReader
+}
 
-	if db, err = sql.Open(c.config.name, connectionString); err != nil {
+func (c *sqlite3Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
 		return nil, err
 	}
+	return hook(conn.(*sqlite3.SQLiteConn), c.middlewareManager, c.reader), nil
+}
 
-	// TODO @droman: might only enable that for `memory` mode?
-	db.SetMaxOpenConns(1)
-	// db.SetMaxIdleConns(1)
-
-	return data.NewMuxDb(db), nil
+func (c *sqlite3Connector) Driver() driver.Driver {
+	return c.driver
 }
 
 func (c Sqlite3Connector) Close() error {
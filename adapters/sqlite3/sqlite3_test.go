@@ -0,0 +1,270 @@
+package adaptersqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+)
+
+type recorder struct {
+	events []data.ChangeEvent
+	err    error
+}
+
+func (r *recorder) OnInit(muxdb *data.MuxDb) error { return nil }
+func (r *recorder) OnClose() error                 { return nil }
+func (r *recorder) OnInsert(event data.ChangeEvent) error {
+	r.events = append(r.events, event)
+	return r.err
+}
+func (r *recorder) OnUpdate(event data.ChangeEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+func (r *recorder) OnDelete(event data.ChangeEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestChangeEventImages(t *testing.T) {
+	recorder := &recorder{}
+	manager := &data.MiddlewareManager{}
+	manager.Register(recorder)
+
+	connector := NewSqlite3Connector(WithMemory()...)
+	muxdb, err := connector.Open(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxdb.Close()
+
+	if err := muxdb.Do(func(db *sql.DB) error {
+		for _, statement := range []string{
+			`CREATE TABLE images (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, payload BLOB)`,
+			`INSERT INTO images (name, payload) VALUES ('first', x'0102')`,
+			`UPDATE images SET name = 'second' WHERE id = 1`,
+			`DELETE FROM images WHERE id = 1`,
+		} {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+			// hooks are dispatched in the background once committed, without the preupdate hook
+			// the new row is read at that time so we let each change be delivered before the next one
+			manager.Wait()
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(recorder.events))
+	}
+
+	insert, update, remove := recorder.events[0], recorder.events[1], recorder.events[2]
+
+	if insert.Op != data.Insert || insert.After["name"] != "first" || insert.Before != nil {
+		t.Errorf("unexpected insert event %+v", insert)
+	}
+	if update.Op != data.Update || update.After["name"] != "second" {
+		t.Errorf("unexpected update event %+v", update)
+	}
+	if remove.Op != data.Delete || remove.After != nil {
+		t.Errorf("unexpected delete event %+v", remove)
+	}
+
+	if !preUpdateHookEnabled {
+		return
+	}
+
+	if update.Before["name"] != "first" {
+		t.Errorf("expected the old name on update, got %+v", update.Before)
+	}
+	if remove.Before["name"] != "second" {
+		t.Errorf("expected the old name on delete, got %+v", remove.Before)
+	}
+	if payload, ok := remove.Before["payload"].([]byte); !ok || len(payload) != 2 {
+		t.Errorf("expected the blob to stay bytes, got %#v", remove.Before["payload"])
+	}
+}
+
+// The columns of a table are read again once it changed, never from within the hooks
+func TestChangeEventImagesAfterAlter(t *testing.T) {
+	recorder := &recorder{}
+	manager := &data.MiddlewareManager{}
+	manager.Register(recorder)
+
+	connector := NewSqlite3Connector(WithMemory()...)
+	muxdb, err := connector.Open(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxdb.Close()
+
+	if err := muxdb.Do(func(db *sql.DB) error {
+		for _, statement := range []string{
+			`CREATE TABLE altered (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL)`,
+			`INSERT INTO altered (name) VALUES ('first')`,
+			`ALTER TABLE altered ADD COLUMN note TEXT NOT NULL DEFAULT 'none'`,
+			`UPDATE altered SET note = 'changed' WHERE id = 1`,
+		} {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+			manager.Wait()
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 2 {
+		t.Fatalf("expected 2 events, got %v", len(recorder.events))
+	}
+	insert, update := recorder.events[0], recorder.events[1]
+	if insert.After["name"] != "first" {
+		t.Errorf("unexpected insert event %+v", insert)
+	}
+	if update.After["name"] != "first" || update.After["note"] != "changed" {
+		t.Errorf("expected the new column in the update event, got %+v", update.After)
+	}
+
+	// sqlite gives NULL or the default for a column added after the row was written, depending on its version
+	if _, ok := update.Before["note"]; preUpdateHookEnabled && (update.Before["name"] != "first" || !ok) {
+		t.Errorf("expected the new column before the update, got %+v", update.Before)
+	}
+}
+
+func TestChangeEventsAfterCommit(t *testing.T) {
+	recorder := &recorder{err: fmt.Errorf("refused")}
+	sunk := []error{}
+	manager := &data.MiddlewareManager{
+		ErrorSink: func(event data.ChangeEvent, err error) {
+			sunk = append(sunk, err)
+		},
+	}
+	manager.Register(recorder)
+
+	connector := NewSqlite3Connector(WithMemory()...)
+	muxdb, err := connector.Open(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxdb.Close()
+
+	if err := muxdb.Do(func(db *sql.DB) error {
+		if _, err := db.Exec(`CREATE TABLE commits (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL)`); err != nil {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO commits (name) VALUES ('rolled back')`); err != nil {
+			return err
+		}
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+
+		tx, err = db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO commits (name) VALUES ('committed')`); err != nil {
+			return err
+		}
+		// nothing is delivered before the commit
+		manager.Wait()
+		if len(recorder.events) != 0 {
+			return fmt.Errorf("received %v events before the commit", len(recorder.events))
+		}
+		return tx.Commit()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.Stop()
+
+	if len(recorder.events) != 1 || recorder.events[0].After["name"] != "committed" {
+		t.Fatalf("expected only the committed row, got %+v", recorder.events)
+	}
+	if len(sunk) != 1 || sunk[0] != recorder.err {
+		t.Errorf("expected the error in the sink, got %v", sunk)
+	}
+}
+
+// The changes are delivered once the call committing them returned, a failed commit delivers nothing
+func TestChangeEventsFailedCommit(t *testing.T) {
+	recorder := &recorder{}
+	manager := &data.MiddlewareManager{}
+	manager.Register(recorder)
+
+	connector := NewSqlite3Connector(DBWithMode(OpenCreateReadWrite), DBWithFile(t.TempDir(), "commits"))
+	muxdb, err := connector.Open(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxdb.Close()
+
+	if err := muxdb.Do(func(db *sql.DB) error {
+		for _, statement := range []string{
+			`PRAGMA busy_timeout = 0`,
+			`CREATE TABLE commits (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL)`,
+			`INSERT INTO commits (name) VALUES ('first')`,
+		} {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	manager.Wait()
+
+	// another process reading the database keeps the writer from committing
+	other, err := sql.Open("sqlite3", connector.config.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	reading, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := reading.QueryRow(`SELECT COUNT(*) FROM commits`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO commits (name) VALUES ('busy')`); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}); err == nil {
+		t.Fatal("expected the commit to fail while the database is read")
+	}
+	reading.Rollback()
+
+	// committed once its rows are read
+	if err := muxdb.Do(func(db *sql.DB) error {
+		var id int64
+		return db.QueryRow(`INSERT INTO commits (name) VALUES ('returning') RETURNING id`).Scan(&id)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	manager.Wait()
+
+	if len(recorder.events) != 2 || recorder.events[0].After["name"] != "first" || recorder.events[1].After["name"] != "returning" {
+		t.Fatalf("expected only the committed rows, got %+v", recorder.events)
+	}
+}
@@ -0,0 +1,41 @@
+package data
+
+type Operation string
+
+var (
+	Insert Operation = "insert"
+	Update Operation = "update"
+	Delete Operation = "delete"
+)
+
+// RowReader gives a middleware read access to the database that produced a change.
+// Queries are written with `?` placeholders, each adapter rebinds them for its driver.
+type RowReader interface {
+	Query(query string, args ...any) ([]map[string]any, error)
+}
+
+// ChangeEvent is what an adapter delivers to the middlewares when a row is inserted, updated or deleted.
+// It doesn't depend on any driver so middlewares can work with every adapter.
+// It is delivered once its transaction committed, the changes of a transaction rolled back or whose commit failed never are.
+type ChangeEvent struct {
+	Op Operation
+	// `main` for sqlite, the schema of the table for postgres
+	Schema string
+	Table  string
+	// Key of the row, `rowid` for sqlite, the `id` column for postgres
+	RowID int64
+	// Key of the row as text, 0 in `RowID` when the `id` column of a postgres table isn't numerical (uuid, text, ...)
+	Key string
+	// Values of the row before the change, nil for inserts or when the adapter can't capture them.
+	// Always nil with sqlite3 unless built with the `sqlite_preupdate_hook` tag.
+	Before map[string]any
+	// Values of the row after the change, nil for deletes.
+	// Without the `sqlite_preupdate_hook` tag, sqlite3 reads it once committed so it can be more recent than the change.
+	After map[string]any
+	// Optional, might be nil when the adapter can't read back from the database
+	Reader RowReader
+}
+
+// ImageLoader reads the `After` image of an event once its transaction committed,
+// for the adapters that can't read the row from within their hooks
+type ImageLoader func(event ChangeEvent) (map[string]any, error)
@@ -0,0 +1,228 @@
+// Package datatest records the statements sent through a `MuxDb` instead of executing them,
+// so the SQL a middleware writes for a dialect can be checked without a server of that dialect.
+package datatest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+)
+
+// One statement received by the database
+type Statement struct {
+	Query string
+	Args  []driver.NamedValue
+}
+
+type Recorder struct {
+	dialect    data.Dialect
+	mu         sync.Mutex
+	statements []Statement
+}
+
+func NewRecorder(dialect data.Dialect) *Recorder {
+	return &Recorder{dialect: dialect}
+}
+
+// MuxDb opens a `MuxDb` of the dialect of the recorder whose statements are recorded.
+// The queries return no rows and the statements affect none, a caller looking something up stops there.
+func (r *Recorder) MuxDb() *data.MuxDb {
+	return data.NewMuxDb(sql.OpenDB(connector{recorder: r}), data.WithDialect(r.dialect))
+}
+
+// Statements returns what was recorded so far, the oldest first
+func (r *Recorder) Statements() []Statement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Statement{}, r.statements...)
+}
+
+func (r *Recorder) record(query string, args []driver.NamedValue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statements = append(r.statements, Statement{Query: query, Args: args})
+}
+
+// Golden compares the recorded statements with the file at `path`, the file is rewritten instead when `update` is set.
+// For postgres every statement must also have been rebound with as many placeholders as arguments.
+func (r *Recorder) Golden(t testing.TB, path string, update bool) {
+	t.Helper()
+
+	var builder strings.Builder
+	for _, statement := range r.Statements() {
+		if r.dialect == data.Postgres {
+			if err := statement.checkPostgres(); err != nil {
+				t.Errorf("%v: %v", err, statement.Query)
+			}
+		}
+		fmt.Fprintf(&builder, "-- %d args\n%v\n\n", len(statement.Args), normalize(statement.Query))
+	}
+	got := builder.String()
+
+	if update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the test with -update to create it", err)
+	}
+	if got != string(expected) {
+		t.Errorf("the statements differ from %v, run the test with -update and review the diff:\n%v", path, got)
+	}
+}
+
+// checkPostgres reports the `?` left outside of the literals and the `$n` placeholders that don't match the arguments
+func (s Statement) checkPostgres() error {
+	highest := 0
+	quoted := false
+	query := []rune(s.Query)
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'':
+			quoted = !quoted
+		case quoted:
+		case query[i] == '?':
+			return errors.New("unbound placeholder")
+		case query[i] == '$':
+			// `$$` quotes the body of a function
+			number := 0
+			for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				i++
+				number = number*10 + int(query[i]-'0')
+			}
+			highest = max(highest, number)
+		}
+	}
+	if highest != len(s.Args) {
+		return fmt.Errorf("%d placeholders for %d arguments", highest, len(s.Args))
+	}
+	return nil
+}
+
+// normalize drops the indentation and the blank lines the queries get from the Go sources
+func normalize(query string) string {
+	lines := []string{}
+	for _, line := range strings.Split(query, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type connector struct {
+	recorder *Recorder
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return conn(c), nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return recorderDriver{}
+}
+
+type recorderDriver struct{}
+
+func (recorderDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("the recorder has no data source name, see `Recorder.MuxDb`")
+}
+
+type conn struct {
+	recorder *Recorder
+}
+
+func (c conn) Prepare(query string) (driver.Stmt, error) {
+	return stmt{recorder: c.recorder, query: query}, nil
+}
+
+func (c conn) Close() error {
+	return nil
+}
+
+func (c conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+func (c conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.recorder.record(query, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (c conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.recorder.record(query, args)
+	return rows{}, nil
+}
+
+type stmt struct {
+	recorder *Recorder
+	query    string
+}
+
+func (s stmt) Close() error {
+	return nil
+}
+
+// the arguments are not checked, `database/sql` hands them over as they are
+func (s stmt) NumInput() int {
+	return -1
+}
+
+func (s stmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.recorder.record(s.query, named(args))
+	return driver.RowsAffected(0), nil
+}
+
+func (s stmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.recorder.record(s.query, named(args))
+	return rows{}, nil
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	values := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		values[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return values
+}
+
+type tx struct{}
+
+func (tx) Commit() error {
+	return nil
+}
+
+func (tx) Rollback() error {
+	return nil
+}
+
+type rows struct{}
+
+func (rows) Columns() []string {
+	return nil
+}
+
+func (rows) Close() error {
+	return nil
+}
+
+func (rows) Next(dest []driver.Value) error {
+	return io.EOF
+}
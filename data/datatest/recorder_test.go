@@ -0,0 +1,33 @@
+package datatest
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestCheckPostgres(t *testing.T) {
+	args := func(count int) []driver.NamedValue {
+		return make([]driver.NamedValue, count)
+	}
+
+	cases := []struct {
+		name      string
+		statement Statement
+		valid     bool
+	}{
+		{name: "rebound", statement: Statement{Query: `UPDATE jobs SET status = $1 WHERE id = $2`, Args: args(2)}, valid: true},
+		{name: "literal", statement: Statement{Query: `SELECT id FROM jobs WHERE error LIKE '?%' AND id = $1`, Args: args(1)}, valid: true},
+		{name: "function body", statement: Statement{Query: `CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN RETURN NULL; END; $$ LANGUAGE plpgsql;`}, valid: true},
+		{name: "unbound", statement: Statement{Query: `UPDATE jobs SET status = $1 WHERE id = ?`, Args: args(2)}},
+		{name: "missing argument", statement: Statement{Query: `UPDATE jobs SET status = $1 WHERE id = $2`, Args: args(1)}},
+		{name: "extra argument", statement: Statement{Query: `SELECT id FROM jobs`, Args: args(1)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.statement.checkPostgres(); (err == nil) != c.valid {
+				t.Errorf("expected valid to be %v, got %v", c.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect identifies the flavor of SQL spoken by the database behind a `MuxDb`.
+// Middlewares write their queries with `?` placeholders and let the dialect rebind them.
+type Dialect string
+
+var (
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+)
+
+// Rebind rewrites the `?` placeholders of a query into the syntax expected by the dialect.
+// Question marks are left untouched within single-quoted literals, double-quoted identifiers,
+// `--` and `/* */` comments and dollar-quoted bodies (`$$ ... $$`, `$body$ ... $body$`).
+// Backslash escapes of `E'...'` literals are not supported, double a quote to escape it.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var builder strings.Builder
+	builder.Grow(len(query) + 8)
+
+	index := 0
+	for i := 0; i < len(query); i++ {
+		if end := quotedEnd(query, i); end > i {
+			builder.WriteString(query[i:end])
+			i = end - 1
+			continue
+		}
+		if query[i] == '?' {
+			index++
+			builder.WriteByte('$')
+			builder.WriteString(strconv.Itoa(index))
+			continue
+		}
+		builder.WriteByte(query[i])
+	}
+
+	return builder.String()
+}
+
+// quotedEnd returns the end of the literal, identifier, comment or body starting at `i`, `i` itself when none starts there.
+// One that never closes runs until the end of the query.
+func quotedEnd(query string, i int) int {
+	closing := func(from int, delimiter string) int {
+		if end := strings.Index(query[from:], delimiter); end >= 0 {
+			return from + end + len(delimiter)
+		}
+		return len(query)
+	}
+
+	switch rest := query[i:]; {
+	case rest[0] == '\'' || rest[0] == '"':
+		// a doubled quote escapes itself, it reads as two literals back to back
+		return closing(i+1, rest[:1])
+	case strings.HasPrefix(rest, "--"):
+		return closing(i, "\n")
+	case strings.HasPrefix(rest, "/*"):
+		// postgres nests them
+		depth := 0
+		for j := i; j+1 < len(query); j++ {
+			switch query[j : j+2] {
+			case "/*":
+				depth++
+				j++
+			case "*/":
+				depth--
+				j++
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return len(query)
+	case rest[0] == '$':
+		if tag := dollarTag(rest); tag != "" {
+			return closing(i+len(tag), tag)
+		}
+	}
+	return i
+}
+
+// dollarTag returns the `$tag$` opening a dollar-quoted body, empty for anything else like the `$1` placeholders
+func dollarTag(query string) string {
+	for i := 1; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '$':
+			return query[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package data
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := `UPDATE jobs SET status = ?, error = '?' WHERE id = ?`
+
+	if rebound := SQLite.Rebind(query); rebound != query {
+		t.Errorf("sqlite should keep the query untouched, got %q", rebound)
+	}
+
+	expected := `UPDATE jobs SET status = $1, error = '?' WHERE id = $2`
+	if rebound := Postgres.Rebind(query); rebound != expected {
+		t.Errorf("expected %q, got %q", expected, rebound)
+	}
+}
+
+func TestRebindQuoted(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "escaped quote",
+			query:    `SELECT 'it''s ?' WHERE a = ?`,
+			expected: `SELECT 'it''s ?' WHERE a = $1`,
+		},
+		{
+			name:     "identifier",
+			query:    `SELECT "what?", "it's" FROM t WHERE a = ?`,
+			expected: `SELECT "what?", "it's" FROM t WHERE a = $1`,
+		},
+		{
+			name:     "line comment",
+			query:    "SELECT a -- isn't it?\nFROM t WHERE a = ?",
+			expected: "SELECT a -- isn't it?\nFROM t WHERE a = $1",
+		},
+		{
+			name:     "block comment",
+			query:    `SELECT a /* why? /* nested? */ isn't it? */ FROM t WHERE a = ?`,
+			expected: `SELECT a /* why? /* nested? */ isn't it? */ FROM t WHERE a = $1`,
+		},
+		{
+			name:     "dollar body",
+			query:    `CREATE FUNCTION f() RETURNS text AS $$ SELECT 'a?' || ? $$ LANGUAGE sql; SELECT ?`,
+			expected: `CREATE FUNCTION f() RETURNS text AS $$ SELECT 'a?' || ? $$ LANGUAGE sql; SELECT $1`,
+		},
+		{
+			name:     "tagged dollar body",
+			query:    `DO $body$ BEGIN RAISE NOTICE '$$ ?'; END $body$; SELECT ?, ?`,
+			expected: `DO $body$ BEGIN RAISE NOTICE '$$ ?'; END $body$; SELECT $1, $2`,
+		},
+		{
+			name:     "unterminated literal",
+			query:    `SELECT ?, 'oops ?`,
+			expected: `SELECT $1, 'oops ?`,
+		},
+		{
+			name:     "multibyte",
+			query:    `SELECT 'héllo?', ? -- ünïcode ?`,
+			expected: `SELECT 'héllo?', $1 -- ünïcode ?`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if rebound := Postgres.Rebind(c.query); rebound != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, rebound)
+			}
+		})
+	}
+}
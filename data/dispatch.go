@@ -0,0 +1,136 @@
+package data
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// ErrorSink receives the errors returned by the middlewares while handling a change event.
+// Hooks are dispatched in the background, there is no caller to return the error to.
+type ErrorSink func(event ChangeEvent, err error)
+
+func defaultErrorSink(event ChangeEvent, err error) {
+	slog.Error("change hook error", slog.Any("op", event.Op), slog.Any("table", event.Table), slog.Any("rowid", event.RowID), slog.Any("error", err))
+}
+
+// Events are queued by the adapters once their transaction committed and handled one batch
+// at a time by a single goroutine, so the middlewares see them in commit order.
+type dispatcher struct {
+	once    sync.Once
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   [][]ChangeEvent
+	running bool
+	stopped bool
+	done    chan struct{}
+}
+
+func (mm *MiddlewareManager) init() {
+	mm.dispatcher.once.Do(func() {
+		mm.dispatcher.cond = sync.NewCond(&mm.dispatcher.mu)
+		mm.dispatcher.done = make(chan struct{})
+		go mm.dispatch()
+	})
+}
+
+// Dispatch queues the events of a committed transaction, they are delivered to the middlewares in the background
+func (mm *MiddlewareManager) Dispatch(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	mm.init()
+
+	mm.dispatcher.mu.Lock()
+	defer mm.dispatcher.mu.Unlock()
+	if mm.dispatcher.stopped {
+		return
+	}
+	mm.dispatcher.queue = append(mm.dispatcher.queue, events)
+	mm.dispatcher.cond.Broadcast()
+}
+
+// Wait blocks until every queued event was handled
+func (mm *MiddlewareManager) Wait() {
+	mm.init()
+
+	mm.dispatcher.mu.Lock()
+	defer mm.dispatcher.mu.Unlock()
+	for len(mm.dispatcher.queue) > 0 || mm.dispatcher.running {
+		mm.dispatcher.cond.Wait()
+	}
+}
+
+// Stop handles the remaining events then stops the dispatcher, later events are dropped
+func (mm *MiddlewareManager) Stop() {
+	mm.init()
+
+	mm.dispatcher.mu.Lock()
+	if mm.dispatcher.stopped {
+		mm.dispatcher.mu.Unlock()
+		return
+	}
+	mm.dispatcher.stopped = true
+	mm.dispatcher.cond.Broadcast()
+	mm.dispatcher.mu.Unlock()
+
+	<-mm.dispatcher.done
+}
+
+func (mm *MiddlewareManager) dispatch() {
+	defer close(mm.dispatcher.done)
+	for {
+		mm.dispatcher.mu.Lock()
+		for len(mm.dispatcher.queue) == 0 && !mm.dispatcher.stopped {
+			mm.dispatcher.cond.Wait()
+		}
+		if len(mm.dispatcher.queue) == 0 {
+			mm.dispatcher.mu.Unlock()
+			return
+		}
+		batch := mm.dispatcher.queue[0]
+		mm.dispatcher.queue = mm.dispatcher.queue[1:]
+		mm.dispatcher.running = true
+		mm.dispatcher.mu.Unlock()
+
+		for _, event := range batch {
+			mm.deliver(event)
+		}
+
+		mm.dispatcher.mu.Lock()
+		mm.dispatcher.running = false
+		mm.dispatcher.cond.Broadcast()
+		mm.dispatcher.mu.Unlock()
+	}
+}
+
+// Every middleware gets the event even if a previous one failed
+func (mm *MiddlewareManager) deliver(event ChangeEvent) {
+	sink := mm.ErrorSink
+	if sink == nil {
+		sink = defaultErrorSink
+	}
+	if mm.ImageLoader != nil && event.After == nil && event.Op != Delete {
+		after, err := mm.ImageLoader(event)
+		if err != nil {
+			sink(event, err)
+		}
+		event.After = after
+	}
+	for _, middleware := range mm.Middlewares {
+		if !mm.interested(middleware, event.Table, event.Op) {
+			continue
+		}
+		var err error
+		switch event.Op {
+		case Insert:
+			err = middleware.OnInsert(event)
+		case Update:
+			err = middleware.OnUpdate(event)
+		case Delete:
+			err = middleware.OnDelete(event)
+		}
+		if err != nil {
+			sink(event, err)
+		}
+	}
+}
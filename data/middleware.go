@@ -1,61 +1,67 @@
 package data
 
-import (
-	"github.com/mattn/go-sqlite3"
-)
-
 type MiddlewareManager struct {
 	Middlewares []Middleware
+	// Where the errors of the change hooks end up, logged when nil
+	ErrorSink ErrorSink
+	// Set by the adapter when the events need their `After` image read before being delivered
+	ImageLoader ImageLoader
+	dispatcher  dispatcher
+	// nil when the middleware receives every change
+	subscriptions map[Middleware][]Subscription
 }
 
 // TODO make a getter for all
 
-func (mm *MiddlewareManager) Register(middleware Middleware) {
+// Register a middleware, the subscriptions take precedence over the ones declared by a `Subscriber`
+func (mm *MiddlewareManager) Register(middleware Middleware, subscriptions ...Subscription) {
 	mm.Middlewares = append(mm.Middlewares, middleware)
-}
 
-func (mm *MiddlewareManager) RunOnInit(muxdb *MuxDb) error {
-	for _, middleware := range mm.Middlewares {
-		if err := middleware.OnInit(muxdb); err != nil {
-			return err
-		}
+	if mm.subscriptions == nil {
+		mm.subscriptions = map[Middleware][]Subscription{}
+	}
+	if len(subscriptions) > 0 {
+		mm.subscriptions[middleware] = subscriptions
+	} else if subscriber, ok := middleware.(Subscriber); ok {
+		mm.subscriptions[middleware] = append([]Subscription{}, subscriber.Subscriptions()...)
 	}
-	return nil
 }
 
-func (mm *MiddlewareManager) RunOnClose() error {
-	for _, middleware := range mm.Middlewares {
-		if err := middleware.OnClose(); err != nil {
-			return err
+func (mm *MiddlewareManager) interested(middleware Middleware, table string, op Operation) bool {
+	subscriptions, ok := mm.subscriptions[middleware]
+	if !ok {
+		return true
+	}
+	for _, subscription := range subscriptions {
+		if subscription.matches(table, op) {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-/// TODO: for now, i will just use `*sqlite3.SQLiteConn` because that's what i'm using...
-/// I'm lacking some inspiration on how i can make this more generic, i will come back to it
-
-func (mm *MiddlewareManager) RunOnInsert(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+// Subscribed tells the adapters whether any middleware cares about a change, so they can skip the work otherwise
+func (mm *MiddlewareManager) Subscribed(table string, op Operation) bool {
 	for _, middleware := range mm.Middlewares {
-		if err := middleware.OnInsert(conn, db, table, rowid); err != nil {
-			return err
+		if mm.interested(middleware, table, op) {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func (mm *MiddlewareManager) RunOnUpdate(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+func (mm *MiddlewareManager) RunOnInit(muxdb *MuxDb) error {
 	for _, middleware := range mm.Middlewares {
-		if err := middleware.OnUpdate(conn, db, table, rowid); err != nil {
+		if err := middleware.OnInit(muxdb); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (mm *MiddlewareManager) RunOnDelete(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+func (mm *MiddlewareManager) RunOnClose() error {
 	for _, middleware := range mm.Middlewares {
-		if err := middleware.OnDelete(conn, db, table, rowid); err != nil {
+		if err := middleware.OnClose(); err != nil {
 			return err
 		}
 	}
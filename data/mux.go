@@ -3,19 +3,55 @@ package data
 import (
 	"database/sql"
 	"sync"
+
+	"github.com/davidroman0O/sql-toolbox/rows"
 )
 
 type MuxDb struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect Dialect
 	sync.RWMutex
 }
 
+type MuxDbOption func(*MuxDb)
+
+// Tell the middlewares which SQL dialect they are talking to, defaults to `SQLite`
+func WithDialect(dialect Dialect) MuxDbOption {
+	return func(m *MuxDb) {
+		m.dialect = dialect
+	}
+}
+
 func (m *MuxDb) Close() {
 	m.RLock()
 	defer m.RUnlock()
 	m.db.Close()
 }
 
+func (m *MuxDb) Dialect() Dialect {
+	return m.dialect
+}
+
+// Shortcut for `m.Dialect().Rebind(query)`
+func (m *MuxDb) Rebind(query string) string {
+	return m.dialect.Rebind(query)
+}
+
+// Query reads rows as maps, which makes the `MuxDb` usable as the `RowReader` of a `ChangeEvent`
+func (m *MuxDb) Query(query string, args ...any) ([]map[string]any, error) {
+	var result []map[string]any
+	err := m.Do(func(db *sql.DB) error {
+		sqlRows, err := db.Query(m.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer sqlRows.Close()
+		result, err = rows.GetSqlRowsMap(sqlRows)
+		return err
+	})
+	return result, err
+}
+
 func (m *MuxDb) Do(cb DoFn) error {
 	m.RLock()
 	defer m.RUnlock()
@@ -41,6 +77,13 @@ func (m *MuxDb) Do(cb DoFn) error {
 	return cb(m.db)
 }
 
-func NewMuxDb(db *sql.DB) *MuxDb {
-	return &MuxDb{db: db}
+func NewMuxDb(db *sql.DB, opts ...MuxDbOption) *MuxDb {
+	muxdb := &MuxDb{
+		db:      db,
+		dialect: SQLite,
+	}
+	for _, opt := range opts {
+		opt(muxdb)
+	}
+	return muxdb
 }
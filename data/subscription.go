@@ -0,0 +1,38 @@
+package data
+
+// Subscription scopes the change events delivered to a middleware
+type Subscription struct {
+	// empty for every table
+	Table string
+	// empty for every operation
+	Ops []Operation
+}
+
+// Subscribe to the changes of one table, every operation when none are given
+func OnTable(table string, ops ...Operation) Subscription {
+	return Subscription{
+		Table: table,
+		Ops:   ops,
+	}
+}
+
+func (s Subscription) matches(table string, op Operation) bool {
+	if s.Table != "" && s.Table != table {
+		return false
+	}
+	if len(s.Ops) == 0 {
+		return true
+	}
+	for _, candidate := range s.Ops {
+		if candidate == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber can be implemented by a middleware to declare the changes it cares about.
+// Middlewares that don't implement it receive every change, an empty list means none.
+type Subscriber interface {
+	Subscriptions() []Subscription
+}
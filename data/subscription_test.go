@@ -0,0 +1,62 @@
+package data
+
+import "testing"
+
+type counter struct {
+	tables []string
+}
+
+func (c *counter) OnInit(muxdb *MuxDb) error { return nil }
+func (c *counter) OnClose() error            { return nil }
+func (c *counter) OnInsert(event ChangeEvent) error {
+	c.tables = append(c.tables, event.Table)
+	return nil
+}
+func (c *counter) OnUpdate(event ChangeEvent) error {
+	c.tables = append(c.tables, event.Table)
+	return nil
+}
+func (c *counter) OnDelete(event ChangeEvent) error {
+	c.tables = append(c.tables, event.Table)
+	return nil
+}
+
+type deaf struct {
+	counter
+}
+
+func (d *deaf) Subscriptions() []Subscription {
+	return []Subscription{}
+}
+
+func TestSubscriptions(t *testing.T) {
+	everything := &counter{}
+	jobs := &counter{}
+	none := &deaf{}
+
+	manager := &MiddlewareManager{}
+	manager.Register(everything)
+	manager.Register(jobs, OnTable("jobs", Insert))
+	manager.Register(none)
+
+	manager.Dispatch([]ChangeEvent{
+		{Op: Insert, Table: "users"},
+		{Op: Insert, Table: "jobs"},
+		{Op: Update, Table: "jobs"},
+	})
+	manager.Stop()
+
+	if len(everything.tables) != 3 {
+		t.Errorf("expected every change, got %v", everything.tables)
+	}
+	if len(jobs.tables) != 1 || jobs.tables[0] != "jobs" {
+		t.Errorf("expected only the jobs insert, got %v", jobs.tables)
+	}
+	if len(none.tables) != 0 {
+		t.Errorf("expected no change, got %v", none.tables)
+	}
+
+	if !manager.Subscribed("users", Delete) {
+		t.Error("users deletes should be subscribed by the catch-all middleware")
+	}
+}
@@ -0,0 +1,78 @@
+// Package cron parses the cron expressions of the middlewares and turns their ticks into rows.
+// The ticks already handled are tracked in a table of the middleware (`name`, `spec`, `last_tick`)
+// so restarts or several instances never handle a tick twice.
+package cron
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	robfig "github.com/robfig/cron/v3"
+)
+
+type Schedule = robfig.Schedule
+
+// Accepts the standard 5 fields, an optional leading seconds field and the descriptors (`@hourly`, `@every 5m`, ...)
+var parser = robfig.NewParser(robfig.SecondOptional | robfig.Minute | robfig.Hour | robfig.Dom | robfig.Month | robfig.Dow | robfig.Descriptor)
+
+func Parse(spec string) (Schedule, error) {
+	return parser.Parse(spec)
+}
+
+// Ticks returns the ticks of `schedule` evaluated in `location` after `last` up to `now`, only the `limit` most recent ones
+func Ticks(schedule Schedule, location *time.Location, last time.Time, now time.Time, limit int) []time.Time {
+	ticks := []time.Time{}
+	for next := schedule.Next(last.In(location)); !next.After(now); next = schedule.Next(next) {
+		ticks = append(ticks, next)
+		if len(ticks) > limit {
+			ticks = ticks[1:]
+		}
+	}
+	return ticks
+}
+
+// Materialize calls `produce` within a transaction with the ticks of the schedule `name` since its last one, as given by `ticks`,
+// and moves its last tick forward. A new schedule starts at `now`, it has nothing to catch up.
+// When another instance moved the last tick first, the transaction is rolled back so its rows are never produced twice.
+func Materialize(muxdb *data.MuxDb, table string, name string, spec string, now time.Time, ticks func(last time.Time) []time.Time, produce func(tx *sql.Tx, ticks []time.Time) error) error {
+	return muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(muxdb.Rebind(`INSERT INTO `+table+` (name, spec, last_tick) VALUES (?, ?, ?) ON CONFLICT (name) DO NOTHING`), name, spec, now.UnixNano()); err != nil {
+			return err
+		}
+
+		var lastTick int64
+		if err := tx.QueryRow(muxdb.Rebind(`SELECT last_tick FROM `+table+` WHERE name = ?`), name).Scan(&lastTick); err != nil {
+			return err
+		}
+
+		due := ticks(time.Unix(0, lastTick))
+		if len(due) == 0 {
+			return tx.Commit()
+		}
+		if err := produce(tx, due); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(muxdb.Rebind(`UPDATE `+table+` SET last_tick = ?, spec = ? WHERE name = ? AND last_tick = ?`), due[len(due)-1].UnixNano(), spec, name, lastTick)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return nil
+		}
+
+		return tx.Commit()
+	})
+}
@@ -2,15 +2,24 @@ package jobs
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type activityType any
 
 type activityFn struct {
 	jobFn
+	// type of the result when the function returns one besides its error
+	jobOutputType reflect.Type
+	// undoes the activity when its workflow gives up, see `ActivityWithCompensation`
+	compensation *reflect.Value
 }
 
 type activityFnOption func(*activityFn)
@@ -27,9 +36,29 @@ func ActivityWithRetries(retries int) activityFnOption {
 	}
 }
 
+// Deadline of the calls of the activity and of its compensation, past it they give up whenever they started
 func ActivityWithTimeout(timeout time.Time) activityFnOption {
 	return func(w *activityFn) {
-		w.jobTimeout = jobTimeout(timeout)
+		w.jobTimeout.at = timeout
+	}
+}
+
+// Time each call of the activity has to complete, counted from its first attempt and across its retries.
+// Each attempt of its compensation gets the same time.
+func ActivityWithTimeoutDuration(timeout time.Duration) activityFnOption {
+	return func(w *activityFn) {
+		w.jobTimeout.run = timeout
+	}
+}
+
+// Compensating action of the activity, run when its workflow gives up after the activity completed.
+// It receives the context then the input and the result of the activity when it has them,
+// `func(ctx context.Context, input In, result Out) error` for example.
+// The compensations of a workflow run in the reverse order of their activities and only once each, even across crashes.
+func ActivityWithCompensation(fn any) activityFnOption {
+	return func(w *activityFn) {
+		compensation := reflect.ValueOf(fn)
+		w.compensation = &compensation
 	}
 }
 
@@ -47,9 +76,9 @@ func Activity(fn any, opts ...activityFnOption) (activityType, error) {
 		},
 	}
 
-	// Check if fn is a function with one or two parameters
+	// Check if fn is a function with one or two parameters, returning an error with an optional result before it
 	fnType := reflect.TypeOf(fn)
-	if fnType.Kind() != reflect.Func || (fnType.NumIn() != 1 && fnType.NumIn() != 2) || fnType.NumOut() != 1 || fnType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+	if fnType.Kind() != reflect.Func || (fnType.NumIn() != 1 && fnType.NumIn() != 2) || (fnType.NumOut() != 1 && fnType.NumOut() != 2) || fnType.Out(fnType.NumOut()-1) != reflect.TypeOf((*error)(nil)).Elem() {
 		return nil, fmt.Errorf("fn must be a function with one or two parameters and a return type of error %v", "")
 	}
 
@@ -65,6 +94,11 @@ func Activity(fn any, opts ...activityFnOption) (activityType, error) {
 	if fnType.NumIn() == 2 {
 		secondParamType = fnType.In(1)
 		config.jobFn.jobInputType = secondParamType
+		config.jobFn.inputFnType = params
+	}
+
+	if fnType.NumOut() == 2 {
+		config.jobOutputType = fnType.Out(0)
 	}
 
 	config.jobFn.jobFnType = jobFnType(fnType)
@@ -74,5 +108,254 @@ func Activity(fn any, opts ...activityFnOption) (activityType, error) {
 		opt(&config)
 	}
 
+	if err := config.validateCompensation(); err != nil {
+		return nil, err
+	}
+
 	return activityType(config), nil
 }
+
+// One recorded call of an activity by a workflow run
+type ActivityRun struct {
+	Sequence int    `json:"sequence"`
+	Name     string `json:"name"`
+	State    State  `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Whether the activity has a compensation, see `ActivityWithCompensation`
+	Compensable bool `json:"compensable"`
+	// State of the compensation, empty until its workflow gives up
+	Compensation         State           `json:"compensation"`
+	CompensationAttempts int             `json:"compensation_attempts"`
+	Input                json.RawMessage `json:"input"`
+	Output               json.RawMessage `json:"output"`
+	Error                *string         `json:"error"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            *time.Time      `json:"updated_at"`
+}
+
+// ExecuteActivity calls an activity from a workflow and records its input, result and error.
+// When the workflow is replayed, after a crash for example, the recorded calls return their stored outcome
+// instead of running again, so the workflow has to call its activities in the same order every time.
+// The result is the one of the activity function, nil when it only returns an error.
+// A failed call with retries left returns its error and stops the run: the job waits in the queue for the backoff,
+// then the workflow is replayed up to the activity which runs again.
+func ExecuteActivity(ctx context.Context, activity activityType, input any) (any, error) {
+	execution, ok := ctx.Value(executionKey{}).(*workflowExecution)
+	if !ok {
+		return nil, fmt.Errorf("activities can only be executed from a workflow")
+	}
+	def, ok := activity.(activityFn)
+	if !ok {
+		return nil, fmt.Errorf("invalid activity type %T", activity)
+	}
+	if def.jobName == "" {
+		return nil, fmt.Errorf("an activity requires a name, see `ActivityName`")
+	}
+
+	if input != nil && reflect.TypeOf(input).Kind() == reflect.Ptr {
+		input = reflect.ValueOf(input).Elem().Interface()
+	}
+	if def.inputFnType == params && (input == nil || reflect.TypeOf(input) != reflect.Type(def.jobInputType)) {
+		return nil, fmt.Errorf("the activity %v expects an input of type %v, got %T", def.jobName, def.jobInputType, input)
+	}
+	if def.inputFnType == single && input != nil {
+		return nil, fmt.Errorf("the activity %v has no input, got %T", def.jobName, input)
+	}
+	// a compensation resumed after a crash only has the name of the activity to find it
+	if def.compensation != nil {
+		if _, ok := execution.middleware.activity(string(def.jobName)); !ok {
+			return nil, fmt.Errorf("the activity %v has a compensation, it has to be registered", def.jobName)
+		}
+	}
+
+	// an activity waits for its retry, the run stops there until the job is claimed again
+	if execution.suspended != nil {
+		return nil, execution.suspended
+	}
+
+	execution.sequence++
+	return execution.middleware.executeActivity(ctx, execution, execution.sequence, def, input)
+}
+
+func (t *JobsMiddleware) executeActivity(ctx context.Context, execution *workflowExecution, sequence int, def activityFn, input any) (any, error) {
+	recorded, found, err := t.recordedActivity(execution.workflowID, sequence)
+	if err != nil {
+		return nil, err
+	}
+	if found && recorded.Name != string(def.jobName) {
+		return nil, fmt.Errorf("the workflow is not deterministic: activity %v was recorded at %d, got %v", recorded.Name, sequence, def.jobName)
+	}
+
+	switch {
+	case found && recorded.State == Completed:
+		return def.decode(recorded.Output)
+	case found && recorded.State == Archived:
+		return nil, errors.New(*recorded.Error)
+	case !found:
+		recorded.CreatedAt = time.Now()
+		payload, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		// the compensations skip the activities without one, registered or not
+		compensable := 0
+		if def.compensation != nil {
+			compensable = 1
+		}
+		if err := t.muxdb.Do(func(db *sql.DB) error {
+			_, err := db.Exec(t.muxdb.Rebind(`INSERT INTO activities (uuid, job_id, workflow_id, name, sequence, status, compensable, input, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`), uuid.NewString(), execution.jobID, execution.workflowID, string(def.jobName), sequence, Active, compensable, string(payload), recorded.CreatedAt.UnixNano())
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	// the timeout counts from the first attempt, even when it ran before a crash
+	deadline := def.jobTimeout.deadline(recorded.CreatedAt)
+	// a call interrupted by a crash or waiting for its retry runs again and keeps its count of attempts
+	attempt := recorded.Attempts + 1
+	var output any
+	attemptCtx, cancel := withDeadline(ctx, deadline)
+	failure := protect(func() error {
+		var err error
+		output, err = def.call(attemptCtx, input)
+		return err
+	})
+	cancel()
+
+	if failure == nil {
+		result, err := json.Marshal(output)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.muxdb.Do(func(db *sql.DB) error {
+			_, err := db.Exec(t.muxdb.Rebind(`UPDATE activities SET status = ?, output = ?, error = NULL, attempts = ?, updated_at = ? WHERE workflow_id = ? AND sequence = ?`), Completed, string(result), attempt, time.Now().UnixNano(), execution.workflowID, sequence)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		return output, nil
+	}
+
+	// interrupted like a crash, the next scheduler runs this attempt again
+	if t.stopping.Err() != nil {
+		return nil, errStopping
+	}
+
+	retry := retryable(ctx, def.jobRetries, deadline, attempt)
+	if err := t.failActivity(execution, sequence, def, attempt, failure, retry); err != nil {
+		return nil, err
+	}
+	if retry {
+		// the job waits in the queue for the backoff instead of the scheduler, the replay of the next claim retries the activity
+		execution.suspended = &retryLater{at: time.Now().Add(t.schedulerConfig.backoff.delay(attempt)), cause: failure}
+	}
+	return nil, failure
+}
+
+// failActivity records the failed attempt of an activity, archiving it when it has no retry left
+func (t *JobsMiddleware) failActivity(execution *workflowExecution, sequence int, def activityFn, attempt int, failure error, retry bool) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		state := Retry
+		if !retry {
+			state = Archived
+		}
+		if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE activities SET status = ?, error = ?, attempts = ?, updated_at = ? WHERE workflow_id = ? AND sequence = ?`), state, failure.Error(), attempt, now.UnixNano(), execution.workflowID, sequence); err != nil {
+			return err
+		}
+		if err := t.recordFailure(tx, JobFailure{JobID: execution.jobID, Name: string(def.jobName), Sequence: sequence, Attempt: attempt, Error: failure.Error(), FailedAt: now}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// call runs the activity function and splits its result from its error
+func (a activityFn) call(ctx context.Context, input any) (any, error) {
+	in := []reflect.Value{reflect.ValueOf(ctx)}
+	if a.inputFnType == params {
+		in = append(in, reflect.ValueOf(input))
+	}
+
+	result := reflect.Value(a.jobFnValue).Call(in)
+
+	var output any
+	if a.jobOutputType != nil {
+		output = result[0].Interface()
+	}
+	if failure := result[len(result)-1]; !failure.IsNil() {
+		return output, failure.Interface().(error)
+	}
+	return output, nil
+}
+
+// decode turns a recorded result back into the type returned by the activity function
+func (a activityFn) decode(output json.RawMessage) (any, error) {
+	if a.jobOutputType == nil {
+		return nil, nil
+	}
+	value := reflect.New(a.jobOutputType)
+	if err := json.Unmarshal(output, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+func (t *JobsMiddleware) recordedActivity(workflowID int64, sequence int) (ActivityRun, bool, error) {
+	activities, err := t.queryActivities(`WHERE a.workflow_id = ? AND a.sequence = ?`, workflowID, sequence)
+	if err != nil || len(activities) == 0 {
+		return ActivityRun{}, false, err
+	}
+	return activities[0], true, nil
+}
+
+// GetActivities returns the recorded activities of a workflow run in the order they were called
+func (t *JobsMiddleware) GetActivities(workflowUUID string) ([]ActivityRun, error) {
+	return t.queryActivities(`JOIN workflows w ON w.id = a.workflow_id WHERE w.uuid = ?`, workflowUUID)
+}
+
+func (t *JobsMiddleware) queryActivities(where string, args ...any) ([]ActivityRun, error) {
+	activities := []ActivityRun{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`SELECT a.sequence, a.name, a.status, a.attempts, a.compensable <> 0, a.compensation, a.compensation_attempts, a.input, a.output, a.error, a.created_at, a.updated_at FROM activities a `+where+` ORDER BY a.sequence`), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			activity := ActivityRun{}
+			var input, output sql.Null[string]
+			var failure, compensation sql.Null[string]
+			var createdAt int64
+			var updatedAt sql.Null[int64]
+			if err := rows.Scan(&activity.Sequence, &activity.Name, &activity.State, &activity.Attempts, &activity.Compensable, &compensation, &activity.CompensationAttempts, &input, &output, &failure, &createdAt, &updatedAt); err != nil {
+				return err
+			}
+			if input.Valid {
+				activity.Input = json.RawMessage(input.V)
+			}
+			if output.Valid {
+				activity.Output = json.RawMessage(output.V)
+			}
+			if failure.Valid {
+				activity.Error = &failure.V
+			}
+			activity.Compensation = State(compensation.V)
+			activity.CreatedAt = time.Unix(0, createdAt)
+			if updatedAt.Valid {
+				updatedAtTime := time.Unix(0, updatedAt.V)
+				activity.UpdatedAt = &updatedAtTime
+			}
+			activities = append(activities, activity)
+		}
+		return rows.Err()
+	})
+	return activities, err
+}
@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/internal/cron"
+)
+
+// Timezone in which the cron expressions of the workflows are evaluated, `time.Local` by default
+func WithTimezone(location *time.Location) schedulerOptions {
+	return func(c *schedulerConfig) {
+		if location != nil {
+			c.location = location
+		}
+	}
+}
+
+// schedule parses the cron expression of a workflow, nil when it has none
+func (w workflowFn) schedule() (cron.Schedule, error) {
+	if w.workflowCron == nil {
+		return nil, nil
+	}
+	if w.inputFnType != single {
+		return nil, fmt.Errorf("the workflow %v has an input, it can't be started by a cron", w.jobName)
+	}
+	schedule, err := cron.Parse(string(*w.workflowCron))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q of the workflow %v: %w", *w.workflowCron, w.jobName, err)
+	}
+	return schedule, nil
+}
+
+// materialize stores a run of each workflow whose cron ticked since the last beat.
+// Only the most recent of the ticks missed while nothing was running starts a run.
+func (t *JobsMiddleware) materialize(now time.Time) error {
+	t.workflowsMu.RLock()
+	schedules := make(map[string]cron.Schedule, len(t.schedules))
+	for name, schedule := range t.schedules {
+		schedules[name] = schedule
+	}
+	t.workflowsMu.RUnlock()
+
+	for name, schedule := range schedules {
+		workflow, ok := t.workflow(name)
+		if !ok {
+			continue
+		}
+		if err := t.materializeCron(workflow, schedule, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *JobsMiddleware) materializeCron(workflow workflowFn, schedule cron.Schedule, now time.Time) error {
+	latest := func(last time.Time) []time.Time {
+		return cron.Ticks(schedule, t.schedulerConfig.location, last, now, 1)
+	}
+	return cron.Materialize(t.muxdb, "job_schedules", string(workflow.jobName), string(*workflow.workflowCron), now, latest, func(tx *sql.Tx, ticks []time.Time) error {
+		_, err := t.storeTx(tx, workflow, nil)
+		return err
+	})
+}
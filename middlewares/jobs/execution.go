@@ -0,0 +1,291 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long a claimed job belongs to its scheduler without news from it, 30s by default.
+// The lease is renewed while the job runs, once expired the job is claimed again by the next beat.
+func WithLease(lease time.Duration) schedulerOptions {
+	return func(c *schedulerConfig) {
+		if lease > 0 {
+			c.lease = lease
+		}
+	}
+}
+
+// One execution of a workflow
+type WorkflowRun struct {
+	UUID      string     `json:"uuid"`
+	Name      string     `json:"name"`
+	JobID     int64      `json:"job_id"`
+	State     State      `json:"status"`
+	Attempts  int        `json:"attempts"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	Error     *string    `json:"error"`
+}
+
+// Done tells if the run reached a final state, `Completed` or `Archived` once its retries are exhausted.
+// A run waiting for its children is not done yet.
+func (r WorkflowRun) Done() bool {
+	return r.State == Completed || r.State == Archived
+}
+
+// WorkflowHandle follows a stored workflow run, it stays valid across restarts as long as its UUID is kept
+type WorkflowHandle struct {
+	UUID       string
+	middleware *JobsMiddleware
+}
+
+// Handle returns the handle of a run started earlier
+func (t *JobsMiddleware) Handle(uuid string) *WorkflowHandle {
+	return &WorkflowHandle{UUID: uuid, middleware: t}
+}
+
+// Status returns the current state of the run
+func (h *WorkflowHandle) Status() (WorkflowRun, error) {
+	return h.middleware.GetWorkflow(h.UUID)
+}
+
+// Wait polls the run until it is done or `ctx` ends, a failed workflow is not an error: check the state of the run
+func (h *WorkflowHandle) Wait(ctx context.Context) (WorkflowRun, error) {
+	ticker := time.NewTicker(h.middleware.schedulerConfig.ticker)
+	defer ticker.Stop()
+	for {
+		run, err := h.Status()
+		if err != nil || run.Done() {
+			return run, err
+		}
+		select {
+		case <-ctx.Done():
+			return run, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *JobsMiddleware) workflow(name string) (workflowFn, bool) {
+	t.workflowsMu.RLock()
+	defer t.workflowsMu.RUnlock()
+	workflow, ok := t.workflows[name]
+	return workflow, ok
+}
+
+// Execute stores a run of a workflow without input, the scheduler runs it
+func (t *JobsMiddleware) Execute(workflow workflowSimple) (*WorkflowHandle, error) {
+	def, err := t.registered(workflow)
+	if err != nil {
+		return nil, err
+	}
+	if def.inputFnType != single {
+		return nil, fmt.Errorf("the workflow %v requires an input, see `ExecuteParams`", def.jobName)
+	}
+	return t.store(def, nil)
+}
+
+// ExecuteParams stores a run of a workflow with its input, the scheduler runs it
+func (t *JobsMiddleware) ExecuteParams(workflow workflowSimple, value interface{}) (*WorkflowHandle, error) {
+	def, err := t.registered(workflow)
+	if err != nil {
+		return nil, err
+	}
+	if def.inputFnType != params {
+		return nil, fmt.Errorf("the workflow %v has no input, see `Execute`", def.jobName)
+	}
+
+	if value != nil && reflect.TypeOf(value).Kind() == reflect.Ptr {
+		value = reflect.ValueOf(value).Elem().Interface()
+	}
+	if value == nil || reflect.TypeOf(value) != reflect.Type(def.jobInputType) {
+		return nil, fmt.Errorf("the workflow %v expects an input of type %v, got %T", def.jobName, def.jobInputType, value)
+	}
+
+	return t.store(def, value)
+}
+
+func (t *JobsMiddleware) registered(workflow workflowSimple) (workflowFn, error) {
+	def, ok := workflow.(workflowFn)
+	if !ok {
+		return workflowFn{}, fmt.Errorf("invalid workflow type %T", workflow)
+	}
+	if _, ok := t.workflow(string(def.jobName)); !ok {
+		return workflowFn{}, fmt.Errorf("the workflow %q is not registered", def.jobName)
+	}
+	return def, nil
+}
+
+// store persists a new run
+func (t *JobsMiddleware) store(def workflowFn, input any) (*WorkflowHandle, error) {
+	var id string
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if id, err = t.storeTx(tx, def, input); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Handle(id), nil
+}
+
+// storeTx persists the job and the workflow row of a new run within `tx` and returns its UUID
+func (t *JobsMiddleware) storeTx(tx *sql.Tx, def workflowFn, input any) (string, error) {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	id := uuid.NewString()
+	var jobID int64
+	if err := tx.QueryRow(t.muxdb.Rebind(`INSERT INTO jobs_queue (status, type, payload, created_at) VALUES (?, ?, ?, ?) RETURNING id`), Enqueued, string(def.jobName), string(payload), time.Now().UnixNano()).Scan(&jobID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(t.muxdb.Rebind(`INSERT INTO workflows (uuid, job_id, name) VALUES (?, ?, ?)`), id, jobID, string(def.jobName)); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// GetWorkflow returns a run of a workflow by its UUID
+func (t *JobsMiddleware) GetWorkflow(id string) (WorkflowRun, error) {
+	run := WorkflowRun{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		var createdAt int64
+		var updatedAt sql.Null[int64]
+		var failure sql.Null[string]
+		err := db.QueryRow(t.muxdb.Rebind(`
+			SELECT w.uuid, w.name, j.id, j.status, j.attempts, j.created_at, j.updated_at, j.error
+			FROM workflows w JOIN jobs_queue j ON j.id = w.job_id
+			WHERE w.uuid = ?
+		`), id).Scan(&run.UUID, &run.Name, &run.JobID, &run.State, &run.Attempts, &createdAt, &updatedAt, &failure)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("workflow %v not found", id)
+		}
+		if err != nil {
+			return err
+		}
+
+		run.CreatedAt = time.Unix(0, createdAt)
+		if updatedAt.Valid {
+			updatedAtTime := time.Unix(0, updatedAt.V)
+			run.UpdatedAt = &updatedAtTime
+		}
+		if failure.Valid {
+			run.Error = &failure.V
+		}
+		return nil
+	})
+	return run, err
+}
+
+type executionKey struct{}
+
+// What a running workflow needs to record its activities
+type workflowExecution struct {
+	middleware *JobsMiddleware
+	workflowID int64
+	jobID      int64
+	// position of the next activity, a replay meets the activities in the same order
+	sequence int
+	// past it the run gives up, zero without `WorkflowWithTimeout` or `WorkflowWithTimeoutDuration`
+	deadline time.Time
+	// set once an activity waits for its retry, the run stops and its job goes back to the queue until then
+	suspended *retryLater
+}
+
+// runWorkflow calls the workflow of a claimed job with its stored input
+func (t *JobsMiddleware) runWorkflow(claimed job[string], workflow workflowFn) error {
+	execution := &workflowExecution{middleware: t, jobID: claimed.ID, deadline: workflow.jobTimeout.deadline(claimed.CreatedAt)}
+	var compensating bool
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		return db.QueryRow(t.muxdb.Rebind(`SELECT id, compensating <> 0 FROM workflows WHERE job_id = ?`), claimed.ID).Scan(&execution.workflowID, &compensating)
+	}); err != nil {
+		return t.setState(claimed.ID, Archived, err)
+	}
+	defer t.renew(claimed.ID)()
+
+	// the previous scheduler stopped in the middle of the compensations, they carry on
+	if compensating {
+		return t.resumeCompensation(execution)
+	}
+
+	if err := t.setState(claimed.ID, Active, nil); err != nil {
+		return err
+	}
+	// the deadline bounds every attempt, past it the workflow gives up
+	ctx, cancel := withDeadline(context.WithValue(t.stopping, executionKey{}, execution), execution.deadline)
+	defer cancel()
+
+	failure := protect(func() error {
+		if workflow.inputFnType == single {
+			return workflow.Call(ctx)
+		}
+		input := reflect.New(workflow.jobInputType)
+		if err := json.Unmarshal([]byte(claimed.Payload), input.Interface()); err != nil {
+			return err
+		}
+		return workflow.CallParam(ctx, input.Elem())
+	})
+	// an activity failed and retries later, the workflow didn't fail whatever it returned
+	if execution.suspended != nil {
+		return t.suspend(claimed.ID, execution.suspended.at)
+	}
+	// the scheduler stopped, the attempt was interrupted rather than failed
+	if failure != nil && t.stopping.Err() != nil {
+		return t.release(claimed.ID)
+	}
+	if failure != nil {
+		return t.failWorkflow(ctx, execution, workflow, failure)
+	}
+
+	return t.complete(claimed.ID)
+}
+
+// renew extends the lease of a running job until the returned function is called
+func (t *JobsMiddleware) renew(id int64) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(t.schedulerConfig.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := t.muxdb.Do(func(db *sql.DB) error {
+					_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET lease_until = ? WHERE id = ? AND status IN (?, ?)`), time.Now().Add(t.schedulerConfig.lease).UnixNano(), id, Active, Compensating)
+					return err
+				}); err != nil {
+					slog.Error("job lease renewal failed", slog.Int64("id", id), slog.Any("error", err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -9,9 +9,14 @@ type jobFnType reflect.Type
 type jobFnValue reflect.Value
 type jobName string
 type jobRetries int
-type jobTimeout time.Time
 type jobInputType reflect.Type
 
+// Deadline of every run (`at`) and time given to each run from its start (`run`), the earliest applies
+type jobTimeout struct {
+	at  time.Time
+	run time.Duration
+}
+
 type jobFn struct {
 	jobName
 	jobRetries
@@ -41,6 +46,10 @@ var (
 	Completed State = "completed"
 	// Job is waiting for an external signal
 	WaitSignal State = "wait_signal"
+	// Workflow gave up and undoes its completed activities before being archived
+	Compensating State = "compensating"
+	// Job is done and waits for its children, see `WaitForChildren`
+	WaitChildren State = "wait_children"
 )
 
 // A job can contain any payload and can be hard deleted.
@@ -48,6 +57,7 @@ var (
 // A job is a stored item that represent a future Task (runtime)
 type job[T any] struct {
 	ID        int64      `json:"id"`
+	ParentID  *int64     `json:"parent_id"`
 	State     State      `json:"status"`
 	Type      string     `json:"type"`
 	Payload   T          `json:"payload"`
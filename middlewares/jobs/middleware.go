@@ -3,25 +3,67 @@ package jobs
 import (
 	"context"
 	"database/sql"
-	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"log"
 	"log/slog"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/davidroman0O/sql-toolbox/rows"
-	"github.com/mattn/go-sqlite3"
-	"github.com/robfig/cron/v3"
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/internal/cron"
+	"github.com/davidroman0O/sql-toolbox/migrations"
 )
 
-func New() *JobsMiddleware {
-	return &JobsMiddleware{
+func New(opts ...schedulerOptions) *JobsMiddleware {
+	jobs := &JobsMiddleware{
 		consumers:  map[string]fnTaskCallback{},
-		workflows:  map[workflowSimple]workflowFn{},
-		activities: map[activityType]activityFn{},
+		workflows:  map[string]workflowFn{},
+		activities: map[string]activityFn{},
+		schedules:  map[string]cron.Schedule{},
+		schedulerConfig: schedulerConfig{
+			ticker:   time.Millisecond * 500,
+			limit:    10,
+			lease:    time.Second * 30,
+			location: time.Local,
+			backoff: backoff{
+				initial: time.Second,
+				max:     time.Minute * 5,
+			},
+		},
+	}
+
+	for _, v := range opts {
+		v(&jobs.schedulerConfig)
+	}
+	jobs.stopping, jobs.stop = context.WithCancel(context.Background())
+
+	return jobs
+}
+
+type schedulerConfig struct {
+	ticker   time.Duration
+	limit    int
+	lease    time.Duration
+	backoff  backoff
+	location *time.Location
+}
+
+type schedulerOptions func(*schedulerConfig)
+
+func WithTicker(ticker time.Duration) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.ticker = ticker
+	}
+}
+
+// Maximum amount of jobs claimed by each beat of the scheduler
+func WithLimit(limit int) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.limit = limit
 	}
 }
 
@@ -46,20 +88,28 @@ type fnTaskCallback struct {
 }
 
 type JobsMiddleware struct {
-	workflows  map[workflowSimple]workflowFn
-	activities map[activityType]activityFn
+	workflows   map[string]workflowFn
+	workflowsMu sync.RWMutex
+	activities  map[string]activityFn
+	// workflows started by their cron, see `WorkflowWithCron`
+	schedules map[string]cron.Schedule
 
-	consumers map[string]fnTaskCallback
-	db        *sql.DB
+	consumers   map[string]fnTaskCallback
+	consumersMu sync.RWMutex
+	muxdb       *data.MuxDb
+
+	schedulerConfig schedulerConfig
 
-	cron     cron.Cron
-	location *time.Location
 	// amount of jobs that are supposedly ready to be scheduled
 	metricJobsToSchedule atomic.Int32
 
 	metricWorkersActive atomic.Int32
 
-	doneScheduler chan struct{}
+	doneScheduler    chan struct{}
+	stoppedScheduler chan struct{}
+	// cancelled by `OnClose` so the runs in progress give their job back instead of holding the scheduler
+	stopping context.Context
+	stop     context.CancelFunc
 }
 
 func (t *JobsMiddleware) ScaleWorker(num int) {
@@ -69,7 +119,8 @@ func (t *JobsMiddleware) ScaleWorker(num int) {
 func (t *JobsMiddleware) Scheduler() {
 	// schedule jobs
 	// schedule scale up and down of workers
-	ticker := time.NewTicker(time.Millisecond * 500)
+	defer close(t.stoppedScheduler)
+	ticker := time.NewTicker(t.schedulerConfig.ticker)
 	for {
 		select {
 		case <-t.doneScheduler:
@@ -77,49 +128,229 @@ func (t *JobsMiddleware) Scheduler() {
 			return
 		case <-ticker.C:
 			if err := t.Beat(); err != nil {
-				slog.Error("scheduler beat failed %v", err)
+				slog.Error("scheduler beat failed", slog.Any("error", err))
 			}
-			// beat the scheduler
-			// check crons
 		}
 	}
 }
 
+// Beat starts the runs of the workflow crons, claims the enqueued jobs that have a consumer or a workflow then runs them.
+// Jobs without consumer stay enqueued until one is registered.
 func (t *JobsMiddleware) Beat() error {
+	if err := t.materialize(time.Now()); err != nil {
+		return err
+	}
+
+	if err := t.settle(); err != nil {
+		return err
+	}
+
+	claimed, err := t.claim()
+	if err != nil {
+		return err
+	}
+
+	// one job failing to update must not strand the others that were claimed with it
+	for _, job := range claimed {
+		if t.stopping.Err() != nil {
+			if err := t.release(job.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := t.run(job); err != nil {
+			slog.Error("job run failed", slog.Int64("id", job.ID), slog.Any("error", err))
+		}
+	}
+
 	return nil
 }
 
+// claim atomically moves a batch of jobs from `Enqueued` or due `Retry` to `Pending` so no other scheduler takes them,
+// the jobs whose lease expired while pending or active are claimed again since their scheduler is gone
+func (t *JobsMiddleware) claim() ([]job[string], error) {
+	t.consumersMu.RLock()
+	types := make([]any, 0, len(t.consumers))
+	for typeFor := range t.consumers {
+		types = append(types, typeFor)
+	}
+	t.consumersMu.RUnlock()
+
+	t.workflowsMu.RLock()
+	for name := range t.workflows {
+		types = append(types, name)
+	}
+	t.workflowsMu.RUnlock()
+
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	// postgres can have multiple schedulers on the same table, sqlite only has one writer
+	lock := ""
+	if t.muxdb.Dialect() == data.Postgres {
+		lock = "FOR UPDATE SKIP LOCKED"
+	}
+
+	claimed := []job[string]{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		now := time.Now()
+		args := []any{Pending, now.UnixNano(), now.Add(t.schedulerConfig.lease).UnixNano(), Enqueued, Retry, now.UnixNano(), Pending, Active, Compensating, now.UnixNano()}
+		args = append(args, types...)
+		args = append(args, t.schedulerConfig.limit)
+
+		rows, err := db.Query(t.muxdb.Rebind(fmt.Sprintf(`
+			UPDATE jobs_queue SET status = ?, updated_at = ?, lease_until = ?
+			WHERE id IN (
+				SELECT id FROM jobs_queue WHERE (status = ? OR (status = ? AND run_at <= ?) OR (status IN (?, ?, ?) AND lease_until < ?)) AND type IN (%v) ORDER BY id LIMIT ? %v
+			)
+			RETURNING id, type, payload, created_at;
+		`, strings.TrimSuffix(strings.Repeat("?, ", len(types)), ", "), lock)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			row := job[string]{State: Pending}
+			var createdAt int64
+			if err := rows.Scan(&row.ID, &row.Type, &row.Payload, &createdAt); err != nil {
+				return err
+			}
+			row.CreatedAt = time.Unix(0, createdAt)
+			claimed = append(claimed, row)
+		}
+		return rows.Err()
+	})
+
+	return claimed, err
+}
+
+// run calls the consumer or the workflow of a claimed job and stores the outcome
+func (t *JobsMiddleware) run(claimed job[string]) error {
+	if workflow, ok := t.workflow(claimed.Type); ok {
+		return t.runWorkflow(claimed, workflow)
+	}
+
+	t.consumersMu.RLock()
+	consumer, ok := t.consumers[claimed.Type]
+	t.consumersMu.RUnlock()
+	if !ok {
+		return t.setState(claimed.ID, Enqueued, nil)
+	}
+
+	if err := t.setState(claimed.ID, Active, nil); err != nil {
+		return err
+	}
+	defer t.renew(claimed.ID)()
+
+	// Now we're going to parse the payload by leveraging the type we gathered from the function of the consumer
+	paramInstancePtr := reflect.New(consumer.in).Interface()
+	//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
+	if err := json.Unmarshal([]byte(claimed.Payload), paramInstancePtr); err != nil {
+		return t.setState(claimed.ID, Archived, err)
+	}
+
+	failure := protect(func() error {
+		// the consumer can spawn children of its job, see `Spawn`
+		ctx := context.WithValue(context.Background(), jobKey{}, &jobContext{middleware: t, id: claimed.ID})
+		result := consumer.fn.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(paramInstancePtr).Elem()})
+		if result[0].IsNil() {
+			return nil
+		}
+		if errCast, ok := result[0].Interface().(error); ok {
+			return errCast
+		}
+		return fmt.Errorf("consumer function must return an error")
+	})
+	if failure != nil {
+		return t.setState(claimed.ID, Archived, failure)
+	}
+
+	return t.complete(claimed.ID)
+}
+
+// release gives a job back to the queue when the scheduler stops in the middle of it,
+// the next scheduler replays it from its recorded activities
+func (t *JobsMiddleware) release(id int64) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ? WHERE id = ?`), Enqueued, time.Now().UnixNano(), id)
+		return err
+	})
+}
+
+func (t *JobsMiddleware) setState(id int64, state State, cause error) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		if cause != nil {
+			_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, error = ? WHERE id = ?`), state, time.Now().UnixNano(), cause.Error(), id)
+			return err
+		}
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, error = NULL WHERE id = ?`), state, time.Now().UnixNano(), id)
+		return err
+	})
+}
+
 func (t *JobsMiddleware) Register(fn any) error {
 	switch fn := fn.(type) {
 	case workflowFn:
-		t.workflows[workflowSimple(fn)] = fn
+		// the name is what the stored runs refer to, it has to survive restarts
+		if fn.jobName == "" {
+			return fmt.Errorf("a workflow requires a name, see `WorkflowName`")
+		}
+		schedule, err := fn.schedule()
+		if err != nil {
+			return err
+		}
+		t.workflowsMu.Lock()
+		defer t.workflowsMu.Unlock()
+		if _, ok := t.workflows[string(fn.jobName)]; ok {
+			return fmt.Errorf("the workflow %v is already registered", fn.jobName)
+		}
+		t.workflows[string(fn.jobName)] = fn
+		if schedule != nil {
+			t.schedules[string(fn.jobName)] = schedule
+		}
 		return nil
 	case activityFn:
-		t.activities[activityType(fn)] = fn
+		// the name is what the recorded results refer to when a workflow is replayed
+		if fn.jobName == "" {
+			return fmt.Errorf("an activity requires a name, see `ActivityName`")
+		}
+		t.workflowsMu.Lock()
+		defer t.workflowsMu.Unlock()
+		if _, ok := t.activities[string(fn.jobName)]; ok {
+			return fmt.Errorf("the activity %v is already registered", fn.jobName)
+		}
+		t.activities[string(fn.jobName)] = fn
 		return nil
 	}
 	return fmt.Errorf("cannot register type %T", fn)
 }
 
-type executionConfig struct{}
+func (t *JobsMiddleware) Push(data interface{}) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
 
-type executionOption func(*executionConfig)
+		if err := t.PushTx(tx, data); err != nil {
+			tx.Rollback()
+			return err
+		}
 
-func (t *JobsMiddleware) Execute(workflow workflowSimple) error {
-	def := workflow.(workflowFn)
-	// TODO: create a job, related to the workflow, and then let the work call it
-	return def.Call(context.Background())
+		return tx.Commit()
+	})
 }
 
-func (t *JobsMiddleware) ExecuteParams(workflow workflowSimple, value interface{}) error {
-	def := workflow.(workflowFn)
-	// TODO: create a job, related to the workflow, and then let the work call it
-	// TODO check that value is the right type
-	return def.CallParam(context.Background(), reflect.ValueOf(value))
+// PushTx stores the job within the caller's transaction, it only exists if the transaction commits
+func (t *JobsMiddleware) PushTx(tx *sql.Tx, data interface{}) error {
+	_, err := t.insertJob(tx, data, nil)
+	return err
 }
 
-func (t *JobsMiddleware) Push(data interface{}) error {
-	var err error
+// insertJob stores a job for the consumer of the type of `data`, under `parentID` when it is a child
+func (t *JobsMiddleware) insertJob(tx *sql.Tx, data interface{}, parentID *int64) (int64, error) {
 	var valueOfWork interface{} = data
 
 	if reflect.TypeOf(data).Kind() == reflect.Ptr {
@@ -129,27 +360,23 @@ func (t *JobsMiddleware) Push(data interface{}) error {
 	// extract the name of the type of the data
 	nameType := reflect.TypeOf(valueOfWork).Name()
 
-	tx, err := t.db.BeginTx(context.Background(), nil)
+	dataJson, err := json.Marshal(valueOfWork)
 	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	var dataJson []byte
-	if dataJson, err = json.Marshal(valueOfWork); err != nil {
-		tx.Rollback()
-		return err
+		return 0, err
 	}
 
-	if _, err = tx.Exec(`
-		INSERT INTO jobs (status, type, payload, created_at) 
-		VALUES (?, ?, ?, ?);
-	`, Enqueued, nameType, string(dataJson), time.Now().UnixNano()); err != nil {
-		tx.Rollback()
-		return err
+	var parent any
+	if parentID != nil {
+		parent = *parentID
 	}
 
-	return tx.Commit()
+	var id int64
+	err = tx.QueryRow(t.muxdb.Rebind(`
+		INSERT INTO jobs_queue (status, type, payload, created_at, parent_id) 
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id;
+	`), Enqueued, nameType, string(dataJson), time.Now().UnixNano(), parent).Scan(&id)
+	return id, err
 }
 
 func (t *JobsMiddleware) On(consumer ConsumerFn) error {
@@ -168,7 +395,9 @@ func (t *JobsMiddleware) On(consumer ConsumerFn) error {
 		// we will be able later on to parse it easily without `map[string]interface{}` conflicts
 		consumer.in = consumer.fnType.In(1)
 
+		t.consumersMu.Lock()
 		t.consumers[consumer.typeFor] = consumer
+		t.consumersMu.Unlock()
 
 	default:
 		return fmt.Errorf("invalid consumer type %T", consumer)
@@ -177,187 +406,350 @@ func (t *JobsMiddleware) On(consumer ConsumerFn) error {
 }
 
 func (t *JobsMiddleware) GetJobs() ([]job[any], error) {
-
-	results, err := t.db.Query("SELECT id, type, payload, status, created_at, updated_at, error FROM jobs")
-	if err != nil {
-		return nil, err
-	}
-
-	defer results.Close()
-
 	jobs := []job[any]{}
 
-	for results.Next() {
-		var j job[any]
-		var createdAt int64
-		var updatedAt int64
-		var payload string
-		var errorS *string
-		err := results.Scan(&j.ID, &j.Type, &payload, &j.State, &createdAt, &updatedAt, &errorS)
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		results, err := db.Query("SELECT id, parent_id, type, payload, status, created_at, updated_at, error FROM jobs_queue ORDER BY id")
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		j.CreatedAt = time.Unix(0, createdAt)
-		if updatedAt != 0 {
-			updatedAtTime := time.Unix(0, updatedAt)
-			j.UpdatedAt = &updatedAtTime
-		}
-		if errorS != nil {
-			j.Error = errorS
-		}
+		defer results.Close()
 
-		oneConsumer := t.consumers[j.Type]
+		for results.Next() {
+			var j job[any]
+			var createdAt int64
+			var updatedAt sql.Null[int64]
+			var payload string
+			var errorS sql.Null[string]
+			var parentID sql.Null[int64]
+			err := results.Scan(&j.ID, &parentID, &j.Type, &payload, &j.State, &createdAt, &updatedAt, &errorS)
+			if err != nil {
+				return err
+			}
+			if parentID.Valid {
+				j.ParentID = &parentID.V
+			}
 
-		// Now we're going to parse the payload by leveraging the type we gathered from the function of the consumer
-		paramInstancePtr := reflect.New(oneConsumer.in).Interface()
-		//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
-		err = json.Unmarshal([]byte(payload), paramInstancePtr)
-		if err != nil {
-			return nil, err
-		}
+			j.CreatedAt = time.Unix(0, createdAt)
+			if updatedAt.Valid {
+				updatedAtTime := time.Unix(0, updatedAt.V)
+				j.UpdatedAt = &updatedAtTime
+			}
+			if errorS.Valid {
+				j.Error = &errorS.V
+			}
 
-		//	convert it back to element and not pointer
-		j.Payload = reflect.ValueOf(paramInstancePtr).Elem().Interface()
+			t.consumersMu.RLock()
+			oneConsumer, ok := t.consumers[j.Type]
+			t.consumersMu.RUnlock()
 
-		jobs = append(jobs, j)
-	}
+			if !ok {
+				// no consumer to tell us the type, keep the raw payload
+				j.Payload = json.RawMessage(payload)
+				jobs = append(jobs, j)
+				continue
+			}
 
-	if err := results.Err(); err != nil {
-		return nil, err
-	}
+			// Now we're going to parse the payload by leveraging the type we gathered from the function of the consumer
+			paramInstancePtr := reflect.New(oneConsumer.in).Interface()
+			//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
+			err = json.Unmarshal([]byte(payload), paramInstancePtr)
+			if err != nil {
+				return err
+			}
+
+			//	convert it back to element and not pointer
+			j.Payload = reflect.ValueOf(paramInstancePtr).Elem().Interface()
+
+			jobs = append(jobs, j)
+		}
 
-	return jobs, nil
+		return results.Err()
+	})
+
+	return jobs, err
 }
 
-func (t *JobsMiddleware) OnInit(db *sql.DB) error {
+func (t *JobsMiddleware) OnInit(muxdb *data.MuxDb) error {
 	log.Println("Jobs middleware initialized")
-	t.db = db
-	// after we check for the table, we start the scheduler
-	defer func() {
-		go t.Scheduler()
-	}()
-	if t.location == nil {
-		t.location = time.Local
+	if muxdb == nil {
+		return fmt.Errorf("jobs middleware requires a database")
 	}
-	t.cron = *cron.New(cron.WithLocation(t.location))
-	return t.initTable()
+	// the tables are created by the migrations, see `Migrations`
+	t.muxdb = muxdb
+
+	t.stopping, t.stop = context.WithCancel(context.Background())
+	t.doneScheduler = make(chan struct{})
+	t.stoppedScheduler = make(chan struct{})
+	go t.Scheduler()
+
+	return nil
 }
 
-func (t *JobsMiddleware) OnClose(db *sql.DB) error {
+// OnClose waits for the scheduler to finish its current beat so nothing touches the database afterwards.
+// The workflows in progress are cancelled and go back to the queue, the waits between their retries are cut short.
+func (t *JobsMiddleware) OnClose() error {
 	log.Println("Jobs middleware closed")
+	t.stop()
+	if t.doneScheduler != nil {
+		close(t.doneScheduler)
+		<-t.stoppedScheduler
+	}
 	return nil
 }
 
-// When job was inserted, we will call the consumer while gathering metrics
-// TODO @droman: when we receive a job, we should push it to a queue and have a goroutine that process it so we can have a better performance
-func (t *JobsMiddleware) OnInsert(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	if table != "jobs" {
-		return nil
+func (t *JobsMiddleware) Subscriptions() []data.Subscription {
+	return []data.Subscription{
+		data.OnTable("jobs_queue", data.Insert),
 	}
+}
 
+// When job was inserted we only gather metrics, the scheduler is the one claiming and running them
+func (t *JobsMiddleware) OnInsert(event data.ChangeEvent) error {
 	//	TODO: went hooked, increase the atomic counter of the number of jobs
 	t.metricJobsToSchedule.Add(1)
 
 	return nil
-
-	log.Printf("Jobs Insert operation on table %s with rowid %d", table, rowid)
-	var err error
-	// simply get it
-	iterator, err := conn.Query(`SELECT id, type, payload, status, created_at FROM jobs WHERE id = ?`, []driver.Value{rowid})
-	if err != nil {
-		return err
-	}
-	defer iterator.Close()
-
-	data, err := rows.GetRowsMap(iterator.Next, rows.WithColumns([]string{"id", "type", "payload", "status", "created_at"}))
-	if err != nil {
-		return err
-	}
-
-	insertedJobs := []job[any]{} // we don't know the type of the job yet... but we will
-
-	for _, value := range data {
-
-		row := job[any]{
-			ID:        value["id"].(int64),
-			State:     State(value["status"].(string)),
-			Type:      value["type"].(string),
-			CreatedAt: time.Unix(0, value["created_at"].(int64)),
-		}
-
-		if oneConsumer, ok := t.consumers[row.Type]; ok {
-
-			// Now we're going to parse the payload by leveraging the type we gathered from the function of the consumer
-			paramInstancePtr := reflect.New(oneConsumer.in).Interface()
-			//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
-			err = json.Unmarshal([]byte(value["payload"].(string)), paramInstancePtr)
-			if err != nil {
-				return err
-			}
-
-			//	convert it back to element and not pointer
-			row.Payload = reflect.ValueOf(paramInstancePtr).Elem().Interface()
-
-			insertedJobs = append(insertedJobs, row)
-		} else {
-			return fmt.Errorf("consumer not found for job type %s", row.Type)
-		}
-
-	}
-
-	for _, job := range insertedJobs {
-		if job.ID <= 0 {
-			// false positive, failed syntax or else
-			slog.Error("job ID is invalid", slog.Any("job", job))
-			continue
-		}
-		// call and manage err
-		result := t.consumers[job.Type].fn.Call([]reflect.Value{reflect.ValueOf(context.Background()), reflect.ValueOf(job.Payload)})
-		var nextState State
-		var err error
-		if !result[0].IsNil() {
-			if errCast, ok := result[0].Interface().(error); ok {
-				nextState = Archived
-				if _, err = conn.Exec(`UPDATE jobs SET status = ?, updated_at = ?, error = ? WHERE id = ?`, []driver.Value{string(nextState), time.Now().UnixNano(), errCast.Error(), job.ID}); err != nil {
-					return err
-				}
-				continue
-			} else {
-				return fmt.Errorf("consumer function must return an error")
-			}
-		}
-		nextState = Completed
-		if _, err = conn.Exec(`UPDATE jobs SET status = ?, updated_at = ? WHERE id = ?`, []driver.Value{string(nextState), time.Now().UnixNano(), job.ID}); err != nil {
-			return err
-		}
-	}
-
-	return nil
 }
 
-func (t *JobsMiddleware) OnUpdate(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	log.Printf("Jobs Update operation on table %s with rowid %d", table, rowid)
+func (t *JobsMiddleware) OnUpdate(event data.ChangeEvent) error {
+	log.Printf("Jobs Update operation on table %s with rowid %d", event.Table, event.RowID)
 	return nil
 }
 
-func (t *JobsMiddleware) OnDelete(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	log.Printf("Jobs Delete operation on table %s with rowid %d", table, rowid)
+func (t *JobsMiddleware) OnDelete(event data.ChangeEvent) error {
+	log.Printf("Jobs Delete operation on table %s with rowid %d", event.Table, event.RowID)
 	return nil
 }
 
-// initTable creates the jobs table if it does not exist
-func (t *JobsMiddleware) initTable() error {
-
-	tx, err := t.db.BeginTx(context.Background(), nil)
-	if err != nil {
-		return err
+const namespace = "jobs"
+
+func (t *JobsMiddleware) Migrations() []migrations.Migration {
+	return []migrations.Migration{
+		{
+			Namespace: namespace,
+			Version:   1,
+			Name:      "create jobs, workflows and activities tables",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite:   migrations.SQL(jobsTable[data.SQLite]),
+				data.Postgres: migrations.SQL(jobsTable[data.Postgres]),
+			}),
+			Down: migrations.SQL(
+				`DROP TABLE IF EXISTS activities;`,
+				`DROP TABLE IF EXISTS workflows;`,
+				`DROP TABLE IF EXISTS jobs;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   2,
+			Name:      "add lease_until and index workflows by uuid",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN lease_until INTEGER NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS workflows_uuid ON workflows (uuid);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN lease_until BIGINT NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS workflows_uuid ON workflows (uuid);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS workflows_uuid;`,
+				`ALTER TABLE jobs DROP COLUMN lease_until;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   3,
+			Name:      "record the calls of the activities",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE activities ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE activities ADD COLUMN status TEXT NOT NULL DEFAULT 'active';`,
+					`ALTER TABLE activities ADD COLUMN input JSON;`,
+					`ALTER TABLE activities ADD COLUMN output JSON;`,
+					`ALTER TABLE activities ADD COLUMN error TEXT NULL;`,
+					`ALTER TABLE activities ADD COLUMN created_at INTEGER;`,
+					`ALTER TABLE activities ADD COLUMN updated_at INTEGER NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS activities_workflow_sequence ON activities (workflow_id, sequence);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE activities ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE activities ADD COLUMN status TEXT NOT NULL DEFAULT 'active';`,
+					`ALTER TABLE activities ADD COLUMN input JSON;`,
+					`ALTER TABLE activities ADD COLUMN output JSON;`,
+					`ALTER TABLE activities ADD COLUMN error TEXT NULL;`,
+					`ALTER TABLE activities ADD COLUMN created_at BIGINT;`,
+					`ALTER TABLE activities ADD COLUMN updated_at BIGINT NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS activities_workflow_sequence ON activities (workflow_id, sequence);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS activities_workflow_sequence;`,
+				`ALTER TABLE activities DROP COLUMN updated_at;`,
+				`ALTER TABLE activities DROP COLUMN created_at;`,
+				`ALTER TABLE activities DROP COLUMN error;`,
+				`ALTER TABLE activities DROP COLUMN output;`,
+				`ALTER TABLE activities DROP COLUMN input;`,
+				`ALTER TABLE activities DROP COLUMN status;`,
+				`ALTER TABLE activities DROP COLUMN sequence;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   4,
+			Name:      "add attempts, run_at and job_failures for retries",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE jobs ADD COLUMN run_at INTEGER NULL;`,
+					`ALTER TABLE activities ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`
+CREATE TABLE IF NOT EXISTS job_failures (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	sequence INTEGER NULL,
+	attempt INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	failed_at INTEGER NOT NULL,
+	FOREIGN KEY (job_id) REFERENCES jobs (id) ON DELETE CASCADE
+);`,
+					`CREATE INDEX IF NOT EXISTS job_failures_job_id ON job_failures (job_id);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE jobs ADD COLUMN run_at BIGINT NULL;`,
+					`ALTER TABLE activities ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`
+CREATE TABLE IF NOT EXISTS job_failures (
+	id BIGSERIAL PRIMARY KEY,
+	job_id BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	sequence INTEGER NULL,
+	attempt INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	failed_at BIGINT NOT NULL,
+	FOREIGN KEY (job_id) REFERENCES jobs (id) ON DELETE CASCADE
+);`,
+					`CREATE INDEX IF NOT EXISTS job_failures_job_id ON job_failures (job_id);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP TABLE IF EXISTS job_failures;`,
+				`ALTER TABLE activities DROP COLUMN attempts;`,
+				`ALTER TABLE jobs DROP COLUMN run_at;`,
+				`ALTER TABLE jobs DROP COLUMN attempts;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   5,
+			Name:      "track the compensations of the workflows",
+			Up: migrations.SQL(
+				`ALTER TABLE workflows ADD COLUMN compensating INTEGER NOT NULL DEFAULT 0;`,
+				`ALTER TABLE activities ADD COLUMN compensation TEXT NULL;`,
+			),
+			Down: migrations.SQL(
+				`ALTER TABLE activities DROP COLUMN compensation;`,
+				`ALTER TABLE workflows DROP COLUMN compensating;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   6,
+			Name:      "add parent_id and wait_children for job trees",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN parent_id INTEGER NULL;`,
+					`ALTER TABLE jobs ADD COLUMN wait_children TEXT NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_parent_id ON jobs (parent_id);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN parent_id BIGINT NULL;`,
+					`ALTER TABLE jobs ADD COLUMN wait_children TEXT NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_parent_id ON jobs (parent_id);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS jobs_parent_id;`,
+				`ALTER TABLE jobs DROP COLUMN wait_children;`,
+				`ALTER TABLE jobs DROP COLUMN parent_id;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   7,
+			Name:      "create job_schedules table for the workflow crons",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS job_schedules (
+	name TEXT PRIMARY KEY,
+	spec TEXT NOT NULL,
+	last_tick INTEGER NOT NULL
+);
+`),
+				data.Postgres: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS job_schedules (
+	name TEXT PRIMARY KEY,
+	spec TEXT NOT NULL,
+	last_tick BIGINT NOT NULL
+);
+`),
+			}),
+			Down: migrations.SQL(`DROP TABLE IF EXISTS job_schedules;`),
+		},
+		{
+			Namespace: namespace,
+			Version:   8,
+			Name:      "record which activities have a compensation",
+			// the activities recorded before it are looked up in the registry when compensated
+			Up:   migrations.SQL(`ALTER TABLE activities ADD COLUMN compensable INTEGER NOT NULL DEFAULT 1;`),
+			Down: migrations.SQL(`ALTER TABLE activities DROP COLUMN compensable;`),
+		},
+		{
+			Namespace: namespace,
+			Version:   9,
+			Name:      "rename jobs to jobs_queue, the tasks middleware owns jobs",
+			// the foreign keys of workflows, activities and job_failures follow the rename
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs RENAME TO jobs_queue;`,
+					`DROP INDEX IF EXISTS jobs_parent_id;`,
+					`CREATE INDEX IF NOT EXISTS jobs_queue_parent_id ON jobs_queue (parent_id);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs RENAME TO jobs_queue;`,
+					`ALTER INDEX IF EXISTS jobs_parent_id RENAME TO jobs_queue_parent_id;`,
+				),
+			}),
+			Down: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs_queue RENAME TO jobs;`,
+					`DROP INDEX IF EXISTS jobs_queue_parent_id;`,
+					`CREATE INDEX IF NOT EXISTS jobs_parent_id ON jobs (parent_id);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs_queue RENAME TO jobs;`,
+					`ALTER INDEX IF EXISTS jobs_queue_parent_id RENAME TO jobs_parent_id;`,
+				),
+			}),
+		},
+		{
+			Namespace: namespace,
+			Version:   10,
+			Name:      "count the attempts of the compensations",
+			Up:        migrations.SQL(`ALTER TABLE activities ADD COLUMN compensation_attempts INTEGER NOT NULL DEFAULT 0;`),
+			Down:      migrations.SQL(`ALTER TABLE activities DROP COLUMN compensation_attempts;`),
+		},
 	}
+}
 
-	_, err = tx.Exec(jobsTable)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	return tx.Commit()
+// Precedes makes the migrations of the jobs run before the ones of the tasks middleware:
+// both first create a table named `jobs`, the jobs one is only renamed by its 9th migration.
+// A database where the tasks migrations already ran without the jobs ones can't add this middleware, its migrations would find the `jobs` of the tasks.
+func (t *JobsMiddleware) Precedes() []string {
+	return []string{"tasks"}
 }
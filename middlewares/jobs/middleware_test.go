@@ -4,9 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/migrations"
 	"github.com/mattn/go-sqlite3"
 )
 
@@ -25,13 +30,13 @@ func TestSimpleWorkflowActivity(t *testing.T) {
 						switch op {
 
 						case sqlite3.SQLITE_INSERT:
-							middleware.OnInsert(conn, db, table, rowid)
+							middleware.OnInsert(data.ChangeEvent{Op: data.Insert, Schema: db, Table: table, RowID: rowid})
 
 						case sqlite3.SQLITE_UPDATE:
-							middleware.OnUpdate(conn, db, table, rowid)
+							middleware.OnUpdate(data.ChangeEvent{Op: data.Update, Schema: db, Table: table, RowID: rowid})
 
 						case sqlite3.SQLITE_DELETE:
-							middleware.OnDelete(conn, db, table, rowid)
+							middleware.OnDelete(data.ChangeEvent{Op: data.Delete, Schema: db, Table: table, RowID: rowid})
 
 						}
 					},
@@ -39,15 +44,25 @@ func TestSimpleWorkflowActivity(t *testing.T) {
 				return nil
 			}})
 
-	var connectionString = ":memory:?cache=shared"
+	var connectionString = "file::memory:?cache=shared"
 	if db, err = sql.Open("sqlite3-extended", connectionString); err != nil {
 		t.Error(err)
 	}
+	// the scheduler and the test share the in-memory database, see `openMemory`
+	db.SetMaxOpenConns(1)
 
-	if err := middleware.OnInit(db); err != nil {
+	muxdb := data.NewMuxDb(db)
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Error(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
 		t.Error(err)
 	}
 
+	defer middleware.OnClose()
+
 	helloWorkflow, err := Workflow(
 		func(ctx context.Context) error {
 			fmt.Println("Hello world")
@@ -67,8 +82,1270 @@ func TestSimpleWorkflowActivity(t *testing.T) {
 		t.Error(err)
 	}
 
-	if err := middleware.Execute(helloWorkflow); err != nil {
-		t.Error(err)
+	handle, err := middleware.Execute(helloWorkflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	run, err := handle.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed {
+		t.Errorf("expected the workflow to complete, got %v", run)
+	}
+
+}
+
+type ExplodingJob struct {
+	Explode bool
+}
+
+func TestConsumerPanic(t *testing.T) {
+	db := openMemory(t, "jobs_panic")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.On(Consumer(func(ctx context.Context, data ExplodingJob) error {
+		if data.Explode {
+			panic("boom")
+		}
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	if err := middleware.Push(ExplodingJob{Explode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.Push(ExplodingJob{Explode: false}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		jobs, err := middleware.GetJobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := map[State]int{}
+		for _, job := range jobs {
+			states[job.State]++
+			if job.State == Archived && (job.Error == nil || !strings.HasPrefix(*job.Error, "panic: boom")) {
+				t.Fatalf("expected the panic to be stored, got %v", job.Error)
+			}
+		}
+		if states[Archived] == 1 && states[Completed] == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("the jobs were not processed after the panic")
+}
+
+type OrderPlaced struct {
+	OrderID int
+}
+
+func TestPushTx(t *testing.T) {
+	db := openMemory(t, "jobs_push_tx")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New()
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	for _, commit := range []bool{true, false} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := middleware.PushTx(tx, OrderPlaced{OrderID: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := middleware.GetJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("expected only the committed job, got %v", jobs)
+	}
+}
+
+type GreetInput struct {
+	Name string
+}
+
+func TestDurableWorkflow(t *testing.T) {
+	db := openMemory(t, "jobs_durable")
+
+	muxdb := data.NewMuxDb(db)
+
+	greeted := make(chan string, 4)
+	greet, err := WorkflowParam(
+		func(ctx context.Context, input GreetInput) error {
+			if input.Name == "" {
+				return fmt.Errorf("nobody to greet")
+			}
+			greeted <- input.Name
+			return nil
+		},
+		WorkflowName("greet"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first process stores a run then crashes in the middle of it
+	crashed := New()
+	crashed.muxdb = muxdb
+	if err := migrations.Apply(muxdb, crashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Register(greet); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Register(greet); err == nil {
+		t.Error("expected a duplicate workflow to be refused")
+	}
+	if _, err := crashed.ExecuteParams(greet, 42); err == nil {
+		t.Error("expected an input of the wrong type to be refused")
+	}
+	if _, err := crashed.Execute(greet); err == nil {
+		t.Error("expected a workflow with input to require one")
+	}
+	stranded, err := crashed.ExecuteParams(greet, GreetInput{Name: "stranded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE jobs_queue SET status = ?, lease_until = ?`, Active, time.Now().Add(-time.Second).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware := New(WithTicker(time.Millisecond * 20))
+	if err := middleware.Register(greet); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	succeeding, err := middleware.ExecuteParams(greet, &GreetInput{Name: "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing, err := middleware.ExecuteParams(greet, GreetInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	for _, handle := range []*WorkflowHandle{middleware.Handle(stranded.UUID), succeeding} {
+		run, err := handle.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.State != Completed || run.Name != "greet" {
+			t.Errorf("expected the run to complete, got %v", run)
+		}
+	}
+
+	run, err := failing.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Archived || run.Error == nil || *run.Error != "nobody to greet" {
+		t.Errorf("expected the run to fail, got %v", run)
+	}
+
+	close(greeted)
+	names := map[string]bool{}
+	for name := range greeted {
+		names[name] = true
+	}
+	if len(names) != 2 || !names["stranded"] || !names["world"] {
+		t.Errorf("expected the stranded and the new run to greet, got %v", names)
+	}
+
+	if _, err := middleware.GetWorkflow("missing"); err == nil {
+		t.Error("expected an unknown workflow to be reported")
+	}
+}
+
+func TestActivityReplay(t *testing.T) {
+	db := openMemory(t, "jobs_activities")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var charges, notifications atomic.Int32
+	charge, err := Activity(func(ctx context.Context, amount int) (string, error) {
+		return fmt.Sprintf("receipt-%d-%d", amount, charges.Add(1)), nil
+	}, ActivityName("charge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify, err := Activity(func(ctx context.Context) error {
+		notifications.Add(1)
+		return nil
+	}, ActivityName("notify"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ExecuteActivity(context.Background(), charge, 42); err == nil {
+		t.Error("expected an activity outside of a workflow to be refused")
+	}
+
+	receipts := make(chan string, 2)
+	checkout, err := Workflow(
+		func(ctx context.Context) error {
+			receipt, err := ExecuteActivity(ctx, charge, 42)
+			if err != nil {
+				return err
+			}
+			receipts <- receipt.(string)
+			_, err = ExecuteActivity(ctx, notify, nil)
+			return err
+		},
+		WorkflowName("checkout"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{charge, notify, checkout} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	handle, err := middleware.Execute(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	run, err := handle.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed {
+		t.Fatalf("expected the workflow to complete, got %v", run)
+	}
+
+	// replayed as if the worker had crashed right before completing it
+	if _, err := db.Exec(`UPDATE jobs_queue SET status = ? WHERE id = ?`, Enqueued, run.JobID); err != nil {
+		t.Fatal(err)
+	}
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed {
+		t.Fatalf("expected the replay to complete, got %v", run)
+	}
+
+	if charges.Load() != 1 || notifications.Load() != 1 {
+		t.Errorf("expected the activities to run once, got %d charges and %d notifications", charges.Load(), notifications.Load())
+	}
+	if first, replayed := <-receipts, <-receipts; first != "receipt-42-1" || replayed != first {
+		t.Errorf("expected the replay to get the recorded receipt, got %v then %v", first, replayed)
+	}
+
+	activities, err := middleware.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 2 || activities[0].Name != "charge" || string(activities[0].Input) != "42" || string(activities[0].Output) != `"receipt-42-1"` || activities[1].Name != "notify" || activities[1].State != Completed {
+		t.Errorf("unexpected recorded activities %v", activities)
+	}
+}
+
+func TestWorkflowRetriesAndDeadlines(t *testing.T) {
+	db := openMemory(t, "jobs_retries")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Millisecond*10, time.Millisecond*20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var flakyCalls atomic.Int32
+	flaky, err := Activity(func(ctx context.Context) (int, error) {
+		if calls := flakyCalls.Add(1); calls < 3 {
+			return 0, fmt.Errorf("flaky call %d", calls)
+		}
+		return 7, nil
+	}, ActivityName("flaky"), ActivityWithRetries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragile, err := Activity(func(ctx context.Context) error {
+		return fmt.Errorf("always broken")
+	}, ActivityName("fragile"), ActivityWithRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovering, err := Workflow(func(ctx context.Context) error {
+		result, err := ExecuteActivity(ctx, flaky, nil)
+		if err != nil {
+			return err
+		}
+		if result.(int) != 7 {
+			return fmt.Errorf("unexpected result %v", result)
+		}
+		return nil
+	}, WorkflowName("recovering"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	givingUp, err := Workflow(func(ctx context.Context) error {
+		_, err := ExecuteActivity(ctx, fragile, nil)
+		return err
+	}, WorkflowName("giving_up"), WorkflowWithRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, err := Workflow(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WorkflowName("late"), WorkflowWithRetries(5), WorkflowWithTimeout(time.Now().Add(time.Millisecond*100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quick, err := Activity(func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+			return nil
+		}
+	}, ActivityName("quick"), ActivityWithTimeoutDuration(time.Millisecond*100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	punctual, err := Workflow(func(ctx context.Context) error {
+		_, err := ExecuteActivity(ctx, quick, nil)
+		return err
+	}, WorkflowName("punctual"), WorkflowWithTimeoutDuration(time.Millisecond*100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{flaky, fragile, recovering, givingUp, late, quick, punctual} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cases := []struct {
+		workflow workflowSimple
+		state    State
+		attempts int
+		failures []string
+	}{
+		{workflow: recovering, state: Completed, attempts: 0, failures: []string{"flaky:1:flaky call 1", "flaky:2:flaky call 2"}},
+		{workflow: givingUp, state: Archived, attempts: 2, failures: []string{"fragile:1:always broken", "fragile:2:always broken", "giving_up:1:always broken", "fragile:1:always broken", "fragile:2:always broken", "giving_up:2:always broken"}},
+		{workflow: late, state: Archived, attempts: 1, failures: []string{"late:1:context deadline exceeded"}},
+		{workflow: punctual, state: Completed, attempts: 0, failures: []string{}},
+	}
+	// the runs start long after the registration, their timeouts count from their creation
+	time.Sleep(time.Millisecond * 200)
+	for _, c := range cases {
+		handle, err := middleware.Execute(c.workflow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run, err := handle.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.State != c.state || run.Attempts != c.attempts {
+			t.Errorf("expected %v to be %v after %d attempts, got %v after %d", run.Name, c.state, c.attempts, run.State, run.Attempts)
+		}
+
+		failures, err := middleware.GetFailures(handle.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, failure := range failures {
+			got = append(got, fmt.Sprintf("%v:%d:%v", failure.Name, failure.Attempt, failure.Error))
+		}
+		if strings.Join(got, ",") != strings.Join(c.failures, ",") {
+			t.Errorf("expected the failures of %v to be %v, got %v", run.Name, c.failures, got)
+		}
+	}
+}
+
+func TestWorkflowShutdown(t *testing.T) {
+	db := openMemory(t, "jobs_shutdown")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Second*5, time.Minute))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	unstable, err := Activity(func(ctx context.Context) error {
+		if calls.Add(1) == 1 {
+			// hangs until the scheduler stops
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, ActivityName("unstable"), ActivityWithRetries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workflow, err := Workflow(func(ctx context.Context) error {
+		_, err := ExecuteActivity(ctx, unstable, nil)
+		return err
+	}, WorkflowName("unstable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{unstable, workflow} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := middleware.Execute(workflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second * 3):
+		t.Fatal("the activity never ran")
+	}
+
+	start := time.Now()
+	if err := middleware.OnClose(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the close to interrupt the activity, it took %v", elapsed)
+	}
+
+	run, err := handle.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Enqueued || run.Attempts != 0 {
+		t.Fatalf("expected the interrupted workflow to go back to the queue, got %v after %d attempts", run.State, run.Attempts)
+	}
+
+	// the next scheduler runs the interrupted attempt again
+	restarted := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Second*5, time.Minute))
+	for _, fn := range []any{unstable, workflow} {
+		if err := restarted.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restarted.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.OnClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed {
+		t.Fatalf("expected the workflow to complete after the restart, got %v", run)
+	}
+
+	activities, err := restarted.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 1 || activities[0].State != Completed || activities[0].Attempts != 1 || calls.Load() != 2 {
+		t.Errorf("expected the interrupted attempt not to count, got %v after %d calls", activities, calls.Load())
+	}
+}
+
+// The retry of an activity waits in the queue, the scheduler runs the other jobs in the meantime
+func TestActivityBackoff(t *testing.T) {
+	db := openMemory(t, "jobs_backoff")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Millisecond*500, time.Second))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	failed := make(chan struct{})
+	unstable, err := Activity(func(ctx context.Context) error {
+		if calls.Add(1) == 1 {
+			close(failed)
+			return fmt.Errorf("unavailable")
+		}
+		return nil
+	}, ActivityName("unstable"), ActivityWithRetries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs atomic.Int32
+	workflow, err := Workflow(func(ctx context.Context) error {
+		runs.Add(1)
+		if _, err := ExecuteActivity(ctx, unstable, nil); err != nil {
+			// the run is suspended whatever the workflow does with the error
+			_, again := ExecuteActivity(ctx, unstable, nil)
+			return again
+		}
+		return nil
+	}, WorkflowName("unstable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumed := make(chan struct{})
+	if err := middleware.On(Consumer(func(ctx context.Context, data BatchJob) error {
+		close(consumed)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{unstable, workflow} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	handle, err := middleware.Execute(workflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("the activity never ran")
+	}
+	if err := middleware.Push(BatchJob{Chunks: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-consumed:
+	case <-time.After(time.Millisecond * 300):
+		t.Fatal("the consumer waited for the backoff of the activity")
+	}
+
+	run, err := handle.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Retry || calls.Load() != 1 {
+		t.Fatalf("expected the workflow to wait for the retry of its activity, got %v after %d calls", run.State, calls.Load())
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed || run.Attempts != 0 || runs.Load() != 2 {
+		t.Fatalf("expected the workflow to complete on its replay without a failed attempt, got %v after %d runs", run, runs.Load())
+	}
+
+	activities, err := middleware.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 1 || activities[0].State != Completed || activities[0].Attempts != 2 || calls.Load() != 2 {
+		t.Errorf("expected the activity to complete on its second attempt, got %v after %d calls", activities, calls.Load())
+	}
+}
+
+type TripInput struct {
+	City string
+}
+
+func TestSagaCompensation(t *testing.T) {
+	db := openMemory(t, "jobs_saga")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Millisecond*10, time.Millisecond*20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var undoneMu sync.Mutex
+	undone := []string{}
+	undo := func(step string) {
+		undoneMu.Lock()
+		defer undoneMu.Unlock()
+		undone = append(undone, step)
+	}
+
+	if _, err := Activity(func(ctx context.Context, trip TripInput) error {
+		return nil
+	}, ActivityName("invalid"), ActivityWithCompensation(func(ctx context.Context) error {
+		return nil
+	})); err == nil {
+		t.Error("expected a compensation without the input to be refused")
+	}
+
+	flight, err := Activity(func(ctx context.Context, trip TripInput) (string, error) {
+		return "flight-to-" + trip.City, nil
+	}, ActivityName("book_flight"), ActivityWithCompensation(func(ctx context.Context, trip TripInput, booking string) error {
+		undo("cancel " + booking)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hotelUndos atomic.Int32
+	hotel, err := Activity(func(ctx context.Context, trip TripInput) (string, error) {
+		return "hotel-in-" + trip.City, nil
+	}, ActivityName("book_hotel"), ActivityWithRetries(1), ActivityWithCompensation(func(ctx context.Context, trip TripInput, booking string) error {
+		// the first attempt fails, the retry of the activity covers its compensation too
+		if hotelUndos.Add(1) == 1 {
+			return fmt.Errorf("hotel unreachable")
+		}
+		undo("cancel " + booking)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay, err := Activity(func(ctx context.Context) error {
+		return fmt.Errorf("card declined")
+	}, ActivityName("pay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var runs atomic.Int32
+	trip, err := WorkflowParam(func(ctx context.Context, trip TripInput) error {
+		runs.Add(1)
+		for _, activity := range []activityType{flight, hotel} {
+			if _, err := ExecuteActivity(ctx, activity, trip); err != nil {
+				return err
+			}
+		}
+		_, err := ExecuteActivity(ctx, pay, nil)
+		return err
+	}, WorkflowName("trip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{flight, hotel, pay, trip} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	handle, err := middleware.ExecuteParams(trip, TripInput{City: "Lyon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	run, err := handle.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Archived || run.Error == nil || *run.Error != "card declined" {
+		t.Fatalf("expected the workflow to give up on the payment, got %v", run)
+	}
+
+	undoneMu.Lock()
+	if strings.Join(undone, ",") != "cancel hotel-in-Lyon,cancel flight-to-Lyon" {
+		t.Errorf("expected the bookings to be cancelled in reverse order, got %v", undone)
+	}
+	undone = undone[:0]
+	undoneMu.Unlock()
+
+	activities, err := middleware.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 3 || activities[0].Compensation != Completed || activities[1].Compensation != Completed || activities[1].CompensationAttempts != 2 || activities[2].Compensation != "" {
+		t.Errorf("expected the completed activities to be compensated, got %v", activities)
+	}
+
+	// the scheduler stopped after cancelling the hotel, the next one only cancels the flight
+	if _, err := db.Exec(`UPDATE activities SET compensation = NULL WHERE sequence = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE jobs_queue SET status = ?, lease_until = ? WHERE id = ?`, Compensating, time.Now().Add(-time.Second).UnixNano(), run.JobID); err != nil {
+		t.Fatal(err)
+	}
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Archived || run.Error == nil || *run.Error != "card declined" {
+		t.Fatalf("expected the resumed compensation to archive the workflow, got %v", run)
+	}
+
+	undoneMu.Lock()
+	defer undoneMu.Unlock()
+	if strings.Join(undone, ",") != "cancel flight-to-Lyon" || runs.Load() != 1 || hotelUndos.Load() != 2 {
+		t.Errorf("expected only the flight to be cancelled again without running the workflow, got %v after %d runs", undone, runs.Load())
+	}
+}
+
+func TestCompensationSkipsUnregistered(t *testing.T) {
+	db := openMemory(t, "jobs_saga_unregistered")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Millisecond*10, time.Millisecond*20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var cancelled atomic.Int32
+	flight, err := Activity(func(ctx context.Context, trip TripInput) (string, error) {
+		return "flight-to-" + trip.City, nil
+	}, ActivityName("flight"), ActivityWithInput[TripInput](), ActivityWithCompensation(func(ctx context.Context, trip TripInput, booking string) error {
+		cancelled.Add(1)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never registered, it has nothing to undo
+	logged, err := Activity(func(ctx context.Context) error {
+		return nil
+	}, ActivityName("log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay, err := Activity(func(ctx context.Context) error {
+		return fmt.Errorf("card declined")
+	}, ActivityName("pay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trip, err := WorkflowParam(func(ctx context.Context, trip TripInput) error {
+		if _, err := ExecuteActivity(ctx, flight, trip); err != nil {
+			return err
+		}
+		if _, err := ExecuteActivity(ctx, logged, nil); err != nil {
+			return err
+		}
+		_, err := ExecuteActivity(ctx, pay, nil)
+		return err
+	}, WorkflowName("trip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{flight, trip} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	handle, err := middleware.ExecuteParams(trip, TripInput{City: "Lyon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	run, err := handle.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Archived || run.Error == nil || *run.Error != "card declined" {
+		t.Fatalf("expected the workflow to be archived with the payment error, got %v", run)
+	}
+	if cancelled.Load() != 1 {
+		t.Errorf("expected the flight to be cancelled once, got %d", cancelled.Load())
+	}
+
+	activities, err := middleware.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 3 || !activities[0].Compensable || activities[0].Compensation != Completed || activities[1].Compensable || activities[1].Compensation != "" {
+		t.Errorf("expected only the flight to be compensated, got %v", activities)
+	}
+}
+
+func TestCompensationShutdown(t *testing.T) {
+	db := openMemory(t, "jobs_compensation_shutdown")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Second*5, time.Minute))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var undos atomic.Int32
+	started := make(chan struct{})
+	reserve, err := Activity(func(ctx context.Context) error {
+		return nil
+	}, ActivityName("reserve"), ActivityWithRetries(3), ActivityWithCompensation(func(ctx context.Context) error {
+		if undos.Add(1) == 1 {
+			// hangs until the scheduler stops
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	charge, err := Activity(func(ctx context.Context) error {
+		return fmt.Errorf("card declined")
+	}, ActivityName("charge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var runs atomic.Int32
+	order, err := Workflow(func(ctx context.Context) error {
+		runs.Add(1)
+		if _, err := ExecuteActivity(ctx, reserve, nil); err != nil {
+			return err
+		}
+		_, err := ExecuteActivity(ctx, charge, nil)
+		return err
+	}, WorkflowName("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []any{reserve, charge, order} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := middleware.Execute(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second * 3):
+		t.Fatal("the compensation never ran")
+	}
+
+	start := time.Now()
+	if err := middleware.OnClose(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the close to interrupt the compensation, it took %v", elapsed)
+	}
+
+	run, err := handle.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Enqueued {
+		t.Fatalf("expected the interrupted compensation to go back to the queue, got %v", run.State)
+	}
+
+	// the next scheduler resumes the compensation without running the workflow again
+	restarted := New(WithTicker(time.Millisecond*20), WithRetryBackoff(time.Second*5, time.Minute))
+	for _, fn := range []any{reserve, charge, order} {
+		if err := restarted.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restarted.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.OnClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Archived || run.Error == nil || *run.Error != "card declined" {
+		t.Fatalf("expected the workflow to be archived once compensated, got %v", run)
+	}
+
+	activities, err := restarted.GetActivities(handle.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 2 || activities[0].Compensation != Completed || activities[0].CompensationAttempts != 1 || undos.Load() != 2 || runs.Load() != 1 {
+		t.Errorf("expected the interrupted compensation to run again without counting, got %v after %d undos and %d runs", activities, undos.Load(), runs.Load())
+	}
+}
+
+type BatchJob struct {
+	Chunks int
+}
+
+type ChunkJob struct {
+	Index int
+	Fail  bool
+}
+
+type LeafJob struct {
+	Index int
+}
+
+func TestJobTrees(t *testing.T) {
+	db := openMemory(t, "jobs_trees")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Spawn(context.Background(), ChunkJob{}); err == nil {
+		t.Error("expected a spawn outside of a job to be refused")
+	}
+
+	// the chunks wait for the batch to be waiting so the fan-in is observed in order
+	release := make(chan struct{})
+	if err := middleware.On(Consumer(func(ctx context.Context, data BatchJob) error {
+		for i := range data.Chunks {
+			if _, err := Spawn(ctx, ChunkJob{Index: i}); err != nil {
+				return err
+			}
+		}
+		return WaitForChildren(ctx, WaitAll)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.On(Consumer(func(ctx context.Context, data ChunkJob) error {
+		<-release
+		if data.Fail {
+			return fmt.Errorf("chunk %d failed", data.Index)
+		}
+		if data.Index == 1 {
+			_, err := Spawn(ctx, &LeafJob{Index: data.Index})
+			return err
+		}
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.On(Consumer(func(ctx context.Context, data LeafJob) error {
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	var races atomic.Int32
+	race, err := Workflow(func(ctx context.Context) error {
+		races.Add(1)
+		for _, chunk := range []ChunkJob{{Index: 10, Fail: true}, {Index: 11}} {
+			if _, err := Spawn(ctx, chunk); err != nil {
+				return err
+			}
+		}
+		return WaitForChildren(ctx, WaitAny)
+	}, WorkflowName("race"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.Register(race); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	if err := middleware.Push(BatchJob{Chunks: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitState := func(id int64, state State) *JobNode {
+		deadline := time.Now().Add(time.Second * 3)
+		for {
+			tree, err := middleware.GetJobTree(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree.State == state {
+				return tree
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected job %d to be %v, got %v", id, state, tree.State)
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+
+	waitState(1, WaitChildren)
+	close(release)
+	tree := waitState(1, Completed)
+
+	if len(tree.Children) != 3 {
+		t.Fatalf("expected 3 chunks, got %v", tree.Children)
+	}
+	for i, chunk := range tree.Children {
+		if chunk.Type != "ChunkJob" || chunk.State != Completed || *chunk.ParentID != tree.ID {
+			t.Errorf("unexpected chunk %d %v", i, chunk)
+		}
+	}
+	if leaves := tree.Children[1].Children; len(leaves) != 1 || leaves[0].Type != "LeafJob" {
+		t.Errorf("expected the second chunk to have a leaf, got %v", leaves)
+	}
+
+	handle, err := middleware.Execute(race)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	run, err := handle.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != Completed {
+		t.Fatalf("expected the race to complete with one chunk, got %v", run)
+	}
+
+	// a replay finds its recorded spawns instead of spawning again
+	if _, err := db.Exec(`UPDATE jobs_queue SET status = ? WHERE id = ?`, Enqueued, run.JobID); err != nil {
+		t.Fatal(err)
+	}
+	if run, err = handle.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = middleware.GetJobTree(run.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if races.Load() != 2 || run.State != Completed || len(tree.Children) != 2 || tree.Children[0].State != Archived || tree.Children[1].State != Completed {
+		t.Errorf("expected the replay to keep its 2 children, got %v after %d runs", tree, races.Load())
+	}
+
+	if _, err := middleware.GetJobTree(404); err == nil {
+		t.Error("expected an unknown job to be reported")
+	}
+}
+
+// openMemory opens a named in-memory database on a single connection,
+// shared cache connections would fail with "table is locked" instead of waiting for each other
+func TestWorkflowCron(t *testing.T) {
+	db := openMemory(t, "jobs_cron")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	every, err := Workflow(func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	}, WorkflowName("every_second"), WorkflowWithCron("* * * * * *"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withInput, err := WorkflowParam(func(ctx context.Context, input GreetInput) error {
+		return nil
+	}, WorkflowName("greet_every_second"), WorkflowWithCron("* * * * * *"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := Workflow(func(ctx context.Context) error {
+		return nil
+	}, WorkflowName("invalid"), WorkflowWithCron("not a cron"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.Register(withInput); err == nil {
+		t.Error("expected a workflow with input to refuse a cron")
+	}
+	if err := middleware.Register(invalid); err == nil {
+		t.Error("expected an invalid cron to be refused")
+	}
+	if err := middleware.Register(every); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the cron to start two runs, got %d", calls.Load())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// a tick starts one run even though the scheduler beats many times per second
+	var runs, ticks int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM workflows WHERE name = ?`, "every_second").Scan(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM job_schedules WHERE name = ?`, "every_second").Scan(&ticks); err != nil {
+		t.Fatal(err)
+	}
+	if ticks != 1 || runs > 3 {
+		t.Errorf("expected one schedule starting a run per second, got %d schedules and %d runs", ticks, runs)
+	}
+}
+
+// A database migrated before the jobs table was renamed keeps its jobs
+func TestRenamedJobsTable(t *testing.T) {
+	db := openMemory(t, "jobs_renamed")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	registry := migrations.NewRegistry()
+	for _, migration := range middleware.Migrations() {
+		if migration.Version < 9 {
+			if err := registry.Register(migration); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := migrations.NewMigrator(muxdb, registry).Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at) VALUES (?, ?, ?, ?)`, Enqueued, "BatchJob", `{"Chunks":1}`, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int, 1)
+	if err := middleware.On(Consumer(func(ctx context.Context, data BatchJob) error {
+		done <- data.Chunks
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	select {
+	case chunks := <-done:
+		if chunks != 1 {
+			t.Fatalf("expected the payload of the old job, got %v chunks", chunks)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("the job pushed before the rename was not consumed")
+	}
+
+	rows, err := muxdb.Query(`SELECT name FROM sqlite_master WHERE name IN ('jobs', 'jobs_parent_id', 'jobs_queue_parent_id')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["name"] != "jobs_queue_parent_id" {
+		t.Fatalf("expected only the renamed index to remain, got %v", rows)
+	}
+}
+
+func openMemory(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
 }
@@ -0,0 +1,26 @@
+package jobs
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is stored as the error of a job whose consumer or workflow panicked
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// protect recovers a panic of `fn` into a `PanicError`, a consumer must never take the scheduler down
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
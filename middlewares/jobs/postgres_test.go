@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/data/datatest"
+	"github.com/davidroman0O/sql-toolbox/migrations"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the postgres statements")
+
+// The statements sent to postgres, rebound and with their locks, without a server.
+// Nothing is ever found so each call stops at its first lookup, `go test -run TestPostgresStatements -update` rewrites them.
+func TestPostgresStatements(t *testing.T) {
+	recorder := datatest.NewRecorder(data.Postgres)
+	muxdb := recorder.MuxDb()
+	middleware := New()
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+	middleware.muxdb = muxdb
+
+	flight, err := Activity(func(ctx context.Context, trip TripInput) (string, error) {
+		return "flight-to-" + trip.City, nil
+	}, ActivityName("flight"), ActivityWithInput[TripInput](), ActivityWithCompensation(func(ctx context.Context, trip TripInput, booking string) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trip, err := WorkflowParam(func(ctx context.Context, trip TripInput) error {
+		return nil
+	}, WorkflowName("trip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nightly, err := Workflow(func(ctx context.Context) error {
+		return nil
+	}, WorkflowName("nightly"), WorkflowWithCron("@daily"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []any{flight, trip, nightly} {
+		if err := middleware.Register(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := middleware.On(Consumer(func(ctx context.Context, data BatchJob) error {
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	execution := &workflowExecution{middleware: middleware, workflowID: 1, jobID: 1}
+	booked := ActivityRun{Sequence: 1, Name: "flight", Input: []byte(`{"City":"Lyon"}`), Output: []byte(`"flight-to-Lyon"`)}
+
+	// the errors are expected, the recorder has no rows to return
+	for _, call := range []func() error{
+		func() error { return middleware.Push(BatchJob{Chunks: 1}) },
+		func() error { _, err := middleware.ExecuteParams(trip, TripInput{City: "Lyon"}); return err },
+		func() error { return middleware.materialize(time.Now()) },
+		func() error { return middleware.settle() },
+		func() error { _, err := middleware.claim(); return err },
+		func() error {
+			_, err := middleware.executeActivity(context.Background(), execution, 1, flight.(activityFn), TripInput{City: "Lyon"})
+			return err
+		},
+		func() error {
+			return middleware.failActivity(execution, 1, flight.(activityFn), 1, fmt.Errorf("unavailable"), true)
+		},
+		func() error {
+			return middleware.failWorkflow(context.Background(), execution, trip.(workflowFn), fmt.Errorf("card declined"))
+		},
+		func() error { return middleware.compensateActivity(execution, flight.(activityFn), booked) },
+		func() error { return middleware.compensate(execution, fmt.Errorf("card declined")) },
+		func() error { _, err := middleware.spawnFromWorkflow(execution, 2, LeafJob{Index: 1}); return err },
+		func() error { return middleware.complete(1) },
+		func() error { return middleware.release(1) },
+		func() error { _, err := middleware.GetWorkflow("uuid"); return err },
+		func() error { _, err := middleware.GetActivities("uuid"); return err },
+		func() error { _, err := middleware.GetFailures("uuid"); return err },
+		func() error { _, err := middleware.GetJobs(); return err },
+		func() error { _, err := middleware.GetJobTree(1); return err },
+	} {
+		call()
+	}
+
+	recorder.Golden(t, "testdata/postgres.golden", *update)
+}
@@ -0,0 +1,193 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// errStopping interrupts a run when the scheduler stops, its job goes back to the queue
+var errStopping = errors.New("the jobs scheduler is stopping")
+
+// retryLater is the failure of an activity or of a compensation that runs again once its backoff elapsed.
+// The job goes back to the queue until then so the scheduler keeps running the other jobs.
+type retryLater struct {
+	at    time.Time
+	cause error
+}
+
+func (r *retryLater) Error() string {
+	return r.cause.Error()
+}
+
+func (r *retryLater) Unwrap() error {
+	return r.cause
+}
+
+// suspend gives a running job back to the queue until `at`, the attempts of the workflow don't change
+func (t *JobsMiddleware) suspend(id int64, at time.Time) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, run_at = ? WHERE id = ?`), Retry, time.Now().UnixNano(), at.UnixNano(), id)
+		return err
+	})
+}
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// Delay before the retries of the workflows, activities and compensations, doubled after each failed attempt up to `max`.
+// Their job waits in the queue meanwhile, 1s up to 5m by default.
+func WithRetryBackoff(initial time.Duration, max time.Duration) schedulerOptions {
+	return func(c *schedulerConfig) {
+		if initial > 0 {
+			c.backoff.initial = initial
+		}
+		if max >= c.backoff.initial {
+			c.backoff.max = max
+		}
+	}
+}
+
+// delay before the attempt following the failed `attempt`
+func (b backoff) delay(attempt int) time.Duration {
+	delay := b.initial
+	for i := 1; i < attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay
+}
+
+// One failed attempt of a workflow or of one of its activities
+type JobFailure struct {
+	JobID int64 `json:"job_id"`
+	// Name of the workflow or of the activity
+	Name string `json:"name"`
+	// Position of the activity in the workflow, 0 for the workflow itself
+	Sequence int       `json:"sequence"`
+	Attempt  int       `json:"attempt"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// deadline of a run started at `start`, zero without timeout
+func (d jobTimeout) deadline(start time.Time) time.Time {
+	deadline := d.at
+	if d.run > 0 && (deadline.IsZero() || start.Add(d.run).Before(deadline)) {
+		deadline = start.Add(d.run)
+	}
+	return deadline
+}
+
+// withDeadline bounds `ctx` by the deadline of a workflow or an activity when it has one
+func withDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// retryable tells if another attempt is allowed after the failed `attempt`
+func retryable(ctx context.Context, retries jobRetries, deadline time.Time, attempt int) bool {
+	if attempt > int(retries) || ctx.Err() != nil {
+		return false
+	}
+	// the next attempt would start past its deadline
+	return deadline.IsZero() || time.Now().Before(deadline)
+}
+
+func (t *JobsMiddleware) recordFailure(tx *sql.Tx, failure JobFailure) error {
+	var sequence any
+	if failure.Sequence > 0 {
+		sequence = failure.Sequence
+	}
+	_, err := tx.Exec(t.muxdb.Rebind(`INSERT INTO job_failures (job_id, name, sequence, attempt, error, failed_at) VALUES (?, ?, ?, ?, ?, ?)`), failure.JobID, failure.Name, sequence, failure.Attempt, failure.Error, failure.FailedAt.UnixNano())
+	return err
+}
+
+// GetFailures returns every failed attempt of a workflow run and of its activities, the oldest first
+func (t *JobsMiddleware) GetFailures(workflowUUID string) ([]JobFailure, error) {
+	failures := []JobFailure{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`
+			SELECT f.job_id, f.name, f.sequence, f.attempt, f.error, f.failed_at
+			FROM job_failures f JOIN workflows w ON w.job_id = f.job_id
+			WHERE w.uuid = ?
+			ORDER BY f.id
+		`), workflowUUID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			failure := JobFailure{}
+			var sequence sql.Null[int64]
+			var failedAt int64
+			if err := rows.Scan(&failure.JobID, &failure.Name, &sequence, &failure.Attempt, &failure.Error, &failedAt); err != nil {
+				return err
+			}
+			failure.Sequence = int(sequence.V)
+			failure.FailedAt = time.Unix(0, failedAt)
+			failures = append(failures, failure)
+		}
+		return rows.Err()
+	})
+	return failures, err
+}
+
+// failWorkflow records the failed attempt of a workflow then schedules its retry or compensates it before archiving it.
+// A retry replays the completed activities and runs again the ones that failed.
+func (t *JobsMiddleware) failWorkflow(ctx context.Context, execution *workflowExecution, workflow workflowFn, cause error) error {
+	gaveUp := false
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var attempts int
+		if err := tx.QueryRow(t.muxdb.Rebind(`SELECT attempts FROM jobs_queue WHERE id = ?`), execution.jobID).Scan(&attempts); err != nil {
+			return err
+		}
+		attempts++
+		now := time.Now()
+
+		if err := t.recordFailure(tx, JobFailure{JobID: execution.jobID, Name: string(workflow.jobName), Attempt: attempts, Error: cause.Error(), FailedAt: now}); err != nil {
+			return err
+		}
+
+		if !retryable(ctx, workflow.jobRetries, execution.deadline, attempts) {
+			// the flag outlives a crash so the next scheduler resumes the compensations instead of the workflow
+			if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE workflows SET compensating = 1 WHERE id = ?`), execution.workflowID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, error = ?, attempts = ?, run_at = NULL WHERE id = ?`), Compensating, now.UnixNano(), cause.Error(), attempts, execution.jobID); err != nil {
+				return err
+			}
+			gaveUp = true
+			return tx.Commit()
+		}
+
+		if _, err := tx.Exec(t.muxdb.Rebind(`DELETE FROM activities WHERE workflow_id = ? AND status = ?`), execution.workflowID, Archived); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, error = ?, attempts = ?, run_at = ? WHERE id = ?`), Retry, now.UnixNano(), cause.Error(), attempts, now.Add(t.schedulerConfig.backoff.delay(attempts)).UnixNano(), execution.jobID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}); err != nil {
+		return err
+	}
+
+	if gaveUp {
+		return t.compensate(execution, cause)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+func (t *JobsMiddleware) activity(name string) (activityFn, bool) {
+	t.workflowsMu.RLock()
+	defer t.workflowsMu.RUnlock()
+	activity, ok := t.activities[name]
+	return activity, ok
+}
+
+// validateCompensation checks that the compensation takes the context, the input then the result of the activity
+func (a activityFn) validateCompensation() error {
+	if a.compensation == nil {
+		return nil
+	}
+
+	expected := []reflect.Type{reflect.TypeOf((*context.Context)(nil)).Elem()}
+	if a.inputFnType == params {
+		expected = append(expected, reflect.Type(a.jobInputType))
+	}
+	if a.jobOutputType != nil {
+		expected = append(expected, a.jobOutputType)
+	}
+
+	fnType := a.compensation.Type()
+	if fnType.Kind() != reflect.Func || fnType.NumIn() != len(expected) || fnType.NumOut() != 1 || fnType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return fmt.Errorf("the compensation of %v must take %v and return an error", a.jobName, expected)
+	}
+	for i, in := range expected {
+		if fnType.In(i) != in {
+			return fmt.Errorf("the compensation of %v must take %v and return an error", a.jobName, expected)
+		}
+	}
+	return nil
+}
+
+// undo calls the compensation with the recorded input and result of the activity
+func (a activityFn) undo(ctx context.Context, recorded ActivityRun) error {
+	in := []reflect.Value{reflect.ValueOf(ctx)}
+	if a.inputFnType == params {
+		input := reflect.New(reflect.Type(a.jobInputType))
+		if err := json.Unmarshal(recorded.Input, input.Interface()); err != nil {
+			return err
+		}
+		in = append(in, input.Elem())
+	}
+	if a.jobOutputType != nil {
+		output := reflect.New(a.jobOutputType)
+		if err := json.Unmarshal(recorded.Output, output.Interface()); err != nil {
+			return err
+		}
+		in = append(in, output.Elem())
+	}
+
+	result := a.compensation.Call(in)
+	if result[0].IsNil() {
+		return nil
+	}
+	return result[0].Interface().(error)
+}
+
+// resumeCompensation carries on the compensations of a workflow that gave up before its scheduler stopped
+func (t *JobsMiddleware) resumeCompensation(execution *workflowExecution) error {
+	if err := t.setCompensating(execution.jobID); err != nil {
+		return err
+	}
+
+	var cause sql.Null[string]
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		return db.QueryRow(t.muxdb.Rebind(`SELECT error FROM jobs_queue WHERE id = ?`), execution.jobID).Scan(&cause)
+	}); err != nil {
+		return err
+	}
+
+	return t.compensate(execution, fmt.Errorf("%v", cause.V))
+}
+
+func (t *JobsMiddleware) setCompensating(id int64) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ? WHERE id = ?`), Compensating, time.Now().UnixNano(), id)
+		return err
+	})
+}
+
+// compensate undoes the completed activities of a workflow that gave up, the latest first, then archives it.
+// Each compensation is marked once done so a crash in the middle never runs it twice.
+func (t *JobsMiddleware) compensate(execution *workflowExecution, cause error) error {
+	activities, err := t.queryActivities(`WHERE a.workflow_id = ? AND a.status = ?`, execution.workflowID, Completed)
+	if err != nil {
+		return err
+	}
+
+	for i := len(activities) - 1; i >= 0; i-- {
+		recorded := activities[i]
+		// a spawned child is a job of its own, it has nothing to undo.
+		// Neither has an activity without compensation, it doesn't even have to be registered
+		if recorded.Compensation == Completed || !recorded.Compensable || strings.HasPrefix(recorded.Name, spawnPrefix) {
+			continue
+		}
+
+		// the next scheduler resumes the compensations where they stopped
+		if t.stopping.Err() != nil {
+			return t.release(execution.jobID)
+		}
+
+		def, ok := t.activity(recorded.Name)
+		if !ok {
+			return t.abandonCompensation(execution, cause, fmt.Errorf("the activity %v is not registered", recorded.Name))
+		}
+		if def.compensation == nil {
+			continue
+		}
+
+		err := t.compensateActivity(execution, def, recorded)
+		if errors.Is(err, errStopping) {
+			return t.release(execution.jobID)
+		}
+		// the workflow stays flagged as compensating, the next claim resumes the compensations from this one
+		var later *retryLater
+		if errors.As(err, &later) {
+			return t.suspend(execution.jobID, later.at)
+		}
+		if err != nil {
+			return t.abandonCompensation(execution, cause, fmt.Errorf("compensation of %v failed: %w", recorded.Name, err))
+		}
+	}
+
+	return t.setState(execution.jobID, Archived, cause)
+}
+
+// compensateActivity runs one attempt of the compensation of an activity, with the retries of the activity.
+// A failed attempt returns a `retryLater` while retries are left, the next claim of the job runs the following one.
+// The workflow deadline is already gone at this point, only the timeout of the activity bounds each attempt, its duration counted from the start of the attempt.
+func (t *JobsMiddleware) compensateActivity(execution *workflowExecution, def activityFn, recorded ActivityRun) error {
+	if err := t.setCompensation(execution, recorded.Sequence, Active); err != nil {
+		return err
+	}
+
+	attempt := recorded.CompensationAttempts + 1
+	ctx, cancel := withDeadline(t.stopping, def.jobTimeout.deadline(time.Now()))
+	failure := protect(func() error {
+		return def.undo(ctx, recorded)
+	})
+	cancel()
+
+	if failure == nil {
+		return t.muxdb.Do(func(db *sql.DB) error {
+			_, err := db.Exec(t.muxdb.Rebind(`UPDATE activities SET compensation = ?, compensation_attempts = ?, updated_at = ? WHERE workflow_id = ? AND sequence = ?`), Completed, attempt, time.Now().UnixNano(), execution.workflowID, recorded.Sequence)
+			return err
+		})
+	}
+	// interrupted like a crash, the compensation stays active and runs again
+	if t.stopping.Err() != nil {
+		return errStopping
+	}
+
+	retry := retryable(context.Background(), def.jobRetries, time.Time{}, attempt)
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		now := time.Now()
+		state := Active
+		if !retry {
+			state = Archived
+		}
+		if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE activities SET compensation = ?, compensation_attempts = ?, updated_at = ? WHERE workflow_id = ? AND sequence = ?`), state, attempt, now.UnixNano(), execution.workflowID, recorded.Sequence); err != nil {
+			return err
+		}
+		if err := t.recordFailure(tx, JobFailure{JobID: execution.jobID, Name: recorded.Name + " compensation", Sequence: recorded.Sequence, Attempt: attempt, Error: failure.Error(), FailedAt: now}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}); err != nil {
+		return err
+	}
+
+	if !retry {
+		return failure
+	}
+	return &retryLater{at: time.Now().Add(t.schedulerConfig.backoff.delay(attempt)), cause: failure}
+}
+
+func (t *JobsMiddleware) setCompensation(execution *workflowExecution, sequence int, state State) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE activities SET compensation = ?, updated_at = ? WHERE workflow_id = ? AND sequence = ?`), state, time.Now().UnixNano(), execution.workflowID, sequence)
+		return err
+	})
+}
+
+// abandonCompensation archives a workflow whose compensations cannot complete, they need a human from there
+func (t *JobsMiddleware) abandonCompensation(execution *workflowExecution, cause error, failure error) error {
+	return t.setState(execution.jobID, Archived, fmt.Errorf("%v, %w", cause, failure))
+}
@@ -1,7 +1,10 @@
 package jobs
 
-// TODO @droman: add parent ID so we can have a tree of jobs for the saga pattern
-var jobsTable = `
+import "github.com/davidroman0O/sql-toolbox/data"
+
+// Tables of the first migration, `jobs` is renamed `jobs_queue` by the 9th so the tasks middleware can have its own `jobs`
+var jobsTable = map[data.Dialect]string{
+	data.SQLite: `
 
 CREATE TABLE IF NOT EXISTS jobs (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -31,4 +34,36 @@ CREATE TABLE IF NOT EXISTS activities (
 	FOREIGN KEY (workflow_id) REFERENCES workflows (id) ON DELETE CASCADE
 );
 
-`
+`,
+	data.Postgres: `
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'enqueued',
+	created_at BIGINT,
+	updated_at BIGINT NULL,
+	payload JSON,
+	error TEXT NULL
+);
+
+CREATE TABLE IF NOT EXISTS workflows (
+	id BIGSERIAL PRIMARY KEY,
+	uuid TEXT NOT NULL,
+	job_id BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	FOREIGN KEY (job_id) REFERENCES jobs (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS activities (
+	id BIGSERIAL PRIMARY KEY,
+	uuid TEXT NOT NULL,
+	job_id BIGINT NOT NULL,
+	workflow_id BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	FOREIGN KEY (job_id) REFERENCES jobs (id) ON DELETE CASCADE,
+	FOREIGN KEY (workflow_id) REFERENCES workflows (id) ON DELETE CASCADE
+);
+
+`,
+}
@@ -0,0 +1,277 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// When a parent job is done with its children
+type WaitPolicy string
+
+var (
+	// The parent completes once every child is done, it is archived if one of them was
+	WaitAll WaitPolicy = "all"
+	// The parent completes as soon as one child completes, it is archived if they all were
+	WaitAny WaitPolicy = "any"
+)
+
+// Prefix of the recorded spawns of a workflow, next to its activities
+const spawnPrefix = "spawn:"
+
+type jobKey struct{}
+
+// What a running consumer needs to spawn children
+type jobContext struct {
+	middleware *JobsMiddleware
+	id         int64
+}
+
+// currentJob returns the job running with `ctx` and the workflow execution when it is one
+func currentJob(ctx context.Context) (*JobsMiddleware, int64, *workflowExecution, bool) {
+	if execution, ok := ctx.Value(executionKey{}).(*workflowExecution); ok {
+		return execution.middleware, execution.jobID, execution, true
+	}
+	if job, ok := ctx.Value(jobKey{}).(*jobContext); ok {
+		return job.middleware, job.id, nil, true
+	}
+	return nil, 0, nil, false
+}
+
+// Spawn pushes a child of the running job from its consumer or its workflow and returns the id of the child.
+// Within a workflow the spawn is recorded like an activity so a replay never spawns the same child twice.
+// From a consumer it isn't idempotent: a consumer that fails after spawning spawns its children again when retried,
+// spawn them from a workflow when a duplicate child is a problem.
+func Spawn(ctx context.Context, data any) (int64, error) {
+	middleware, parentID, execution, ok := currentJob(ctx)
+	if !ok {
+		return 0, fmt.Errorf("children can only be spawned from a consumer or a workflow")
+	}
+	if data == nil {
+		return 0, fmt.Errorf("a child requires a payload")
+	}
+
+	if execution == nil {
+		var id int64
+		err := middleware.muxdb.Do(func(db *sql.DB) error {
+			tx, err := db.BeginTx(context.Background(), nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if id, err = middleware.insertJob(tx, data, &parentID); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+		return id, err
+	}
+
+	execution.sequence++
+	return middleware.spawnFromWorkflow(execution, execution.sequence, data)
+}
+
+func (t *JobsMiddleware) spawnFromWorkflow(execution *workflowExecution, sequence int, data any) (int64, error) {
+	value := reflect.ValueOf(data)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	name := spawnPrefix + value.Type().Name()
+
+	recorded, found, err := t.recordedActivity(execution.workflowID, sequence)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		if recorded.Name != name {
+			return 0, fmt.Errorf("the workflow is not deterministic: %v was recorded at %d, got %v", recorded.Name, sequence, name)
+		}
+		var id int64
+		err := json.Unmarshal(recorded.Output, &id)
+		return id, err
+	}
+
+	var id int64
+	err = t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if id, err = t.insertJob(tx, data, &execution.jobID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(t.muxdb.Rebind(`INSERT INTO activities (uuid, job_id, workflow_id, name, sequence, status, attempts, compensable, input, output, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`), uuid.NewString(), execution.jobID, execution.workflowID, name, sequence, Completed, 1, 0, "null", fmt.Sprint(id), time.Now().UnixNano()); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	return id, err
+}
+
+// WaitForChildren keeps the running job in `WaitChildren` once its consumer or workflow returns,
+// until its children are done according to `policy`. Without children the job completes right away.
+func WaitForChildren(ctx context.Context, policy WaitPolicy) error {
+	middleware, id, _, ok := currentJob(ctx)
+	if !ok {
+		return fmt.Errorf("only a consumer or a workflow can wait for its children")
+	}
+	if policy != WaitAll && policy != WaitAny {
+		return fmt.Errorf("invalid wait policy %q", policy)
+	}
+	return middleware.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(middleware.muxdb.Rebind(`UPDATE jobs_queue SET wait_children = ? WHERE id = ?`), policy, id)
+		return err
+	})
+}
+
+// complete marks a successful job `Completed`, or `WaitChildren` when it waits for the children it has
+func (t *JobsMiddleware) complete(id int64) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`
+			UPDATE jobs_queue SET updated_at = ?, error = NULL, status = CASE
+				WHEN wait_children IS NOT NULL AND EXISTS (SELECT 1 FROM jobs_queue c WHERE c.parent_id = jobs_queue.id) THEN ?
+				ELSE ?
+			END
+			WHERE id = ?
+		`), time.Now().UnixNano(), WaitChildren, Completed, id)
+		return err
+	})
+}
+
+// settle completes or archives the parents whose children are done according to their policy
+func (t *JobsMiddleware) settle() error {
+	type waiting struct {
+		id                         int64
+		policy                     WaitPolicy
+		total, completed, archived int
+	}
+
+	return t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`
+			SELECT p.id, p.wait_children, COUNT(c.id),
+				SUM(CASE WHEN c.status = ? THEN 1 ELSE 0 END),
+				SUM(CASE WHEN c.status = ? THEN 1 ELSE 0 END)
+			FROM jobs_queue p JOIN jobs_queue c ON c.parent_id = p.id
+			WHERE p.status = ?
+			GROUP BY p.id, p.wait_children
+		`), Completed, Archived, WaitChildren)
+		if err != nil {
+			return err
+		}
+		parents := []waiting{}
+		for rows.Next() {
+			parent := waiting{}
+			if err := rows.Scan(&parent.id, &parent.policy, &parent.total, &parent.completed, &parent.archived); err != nil {
+				rows.Close()
+				return err
+			}
+			parents = append(parents, parent)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, parent := range parents {
+			var state State
+			var failure any
+			switch {
+			case parent.policy == WaitAny && parent.completed > 0:
+				state = Completed
+			case parent.policy == WaitAny && parent.archived == parent.total:
+				state, failure = Archived, "every child failed"
+			case parent.policy == WaitAll && parent.completed+parent.archived == parent.total && parent.archived > 0:
+				state, failure = Archived, fmt.Sprintf("%d of %d children failed", parent.archived, parent.total)
+			case parent.policy == WaitAll && parent.completed == parent.total:
+				state = Completed
+			default:
+				continue
+			}
+			if _, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs_queue SET status = ?, updated_at = ?, error = ? WHERE id = ? AND status = ?`), state, time.Now().UnixNano(), failure, parent.id, WaitChildren); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// A job with its descendants
+type JobNode struct {
+	ID        int64      `json:"id"`
+	ParentID  *int64     `json:"parent_id"`
+	Type      string     `json:"type"`
+	State     State      `json:"status"`
+	Error     *string    `json:"error"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	Children  []*JobNode `json:"children"`
+}
+
+// GetJobTree returns a job with all its descendants and their states, the children in the order they were spawned
+func (t *JobsMiddleware) GetJobTree(id int64) (*JobNode, error) {
+	nodes := map[int64]*JobNode{}
+	order := []*JobNode{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`
+			WITH RECURSIVE tree (id) AS (
+				SELECT id FROM jobs_queue WHERE id = ?
+				UNION ALL
+				SELECT j.id FROM jobs_queue j JOIN tree ON j.parent_id = tree.id
+			)
+			SELECT id, parent_id, type, status, error, created_at, updated_at
+			FROM jobs_queue WHERE id IN (SELECT id FROM tree)
+			ORDER BY id
+		`), id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			node := &JobNode{Children: []*JobNode{}}
+			var parentID sql.Null[int64]
+			var failure sql.Null[string]
+			var createdAt int64
+			var updatedAt sql.Null[int64]
+			if err := rows.Scan(&node.ID, &parentID, &node.Type, &node.State, &failure, &createdAt, &updatedAt); err != nil {
+				return err
+			}
+			if parentID.Valid {
+				node.ParentID = &parentID.V
+			}
+			if failure.Valid {
+				node.Error = &failure.V
+			}
+			node.CreatedAt = time.Unix(0, createdAt)
+			if updatedAt.Valid {
+				updatedAtTime := time.Unix(0, updatedAt.V)
+				node.UpdatedAt = &updatedAtTime
+			}
+			nodes[node.ID] = node
+			order = append(order, node)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("job %v not found", id)
+	}
+	for _, node := range order {
+		if node.ID != id && node.ParentID != nil {
+			nodes[*node.ParentID].Children = append(nodes[*node.ParentID].Children, node)
+		}
+	}
+	return root, nil
+}
@@ -12,7 +12,6 @@ type workflowSimple any
 type workflowParam any
 
 ///	TODO: how do i want to manage queues? Maybe we could have workers for set of queues?
-///	TODO: how do i want to manage retries?
 
 type workflowFn struct {
 	ID   int64
@@ -98,13 +97,25 @@ func WorkflowWithRetries(retries int) workflowFnOption {
 	}
 }
 
+// Deadline of the runs of the workflow, past it they give up whenever they started
 func WorkflowWithTimeout(timeout time.Time) workflowFnOption {
 	return func(w *workflowFn) error {
-		w.jobTimeout = jobTimeout(timeout)
+		w.jobTimeout.at = timeout
 		return nil
 	}
 }
 
+// Time each run has to complete, counted from its creation and across its retries, past it the workflow gives up
+func WorkflowWithTimeoutDuration(timeout time.Duration) workflowFnOption {
+	return func(w *workflowFn) error {
+		w.jobTimeout.run = timeout
+		return nil
+	}
+}
+
+// Start a run of the workflow at each tick of `cron`, evaluated in the timezone given by `WithTimezone`.
+// The ticks are tracked in `job_schedules` so restarts or several instances never start a tick twice.
+// Only workflows without input can have a cron, `Register` refuses the others.
 func WorkflowWithCron(cron string) workflowFnOption {
 	return func(w *workflowFn) error {
 		w.workflowCron = (*workflowCron)(&cron)
@@ -4,7 +4,6 @@ import (
 	"log"
 
 	"github.com/davidroman0O/sql-toolbox/data"
-	"github.com/mattn/go-sqlite3"
 )
 
 func New() *LoggerMiddleware {
@@ -23,17 +22,17 @@ func (l *LoggerMiddleware) OnClose() error {
 	return nil
 }
 
-func (l *LoggerMiddleware) OnInsert(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	log.Printf("Logger Insert operation on table %s with rowid %d", table, rowid)
+func (l *LoggerMiddleware) OnInsert(event data.ChangeEvent) error {
+	log.Printf("Logger Insert operation on table %s with rowid %d", event.Table, event.RowID)
 	return nil
 }
 
-func (l *LoggerMiddleware) OnUpdate(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	log.Printf("Logger Update operation on table %s with rowid %d", table, rowid)
+func (l *LoggerMiddleware) OnUpdate(event data.ChangeEvent) error {
+	log.Printf("Logger Update operation on table %s with rowid %d", event.Table, event.RowID)
 	return nil
 }
 
-func (l *LoggerMiddleware) OnDelete(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
-	log.Printf("Logger Delete operation on table %s with rowid %d", table, rowid)
+func (l *LoggerMiddleware) OnDelete(event data.ChangeEvent) error {
+	log.Printf("Logger Delete operation on table %s with rowid %d", event.Table, event.RowID)
 	return nil
 }
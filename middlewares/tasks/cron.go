@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/internal/cron"
+)
+
+// What to do with the ticks that passed while nothing was running
+type MissedTicks string
+
+var (
+	// Every missed tick becomes a task
+	CatchUp MissedTicks = "catch_up"
+	// Only the most recent missed tick becomes a task
+	SkipMissed MissedTicks = "skip_missed"
+)
+
+// Upper bound of the tasks created by one catch up, older ticks are dropped
+const maxCatchUp = 1000
+
+type cronSchedule struct {
+	spec     string
+	schedule cron.Schedule
+	location *time.Location
+	missed   MissedTicks
+	factory  reflect.Value
+	// queue and priority of the produced tasks
+	send []sendOptions
+}
+
+// Timezone in which the cron expression is evaluated, `time.Local` by default
+func WithTimezone(location *time.Location) handlerOptions {
+	return func(h *ReceiverHandler) {
+		if h.schedule != nil && location != nil {
+			h.schedule.location = location
+		}
+	}
+}
+
+// Policy for the ticks missed during a downtime, `SkipMissed` by default
+func WithMissedTicks(policy MissedTicks) handlerOptions {
+	return func(h *ReceiverHandler) {
+		if h.schedule != nil {
+			h.schedule.missed = policy
+		}
+	}
+}
+
+// Options of the tasks produced by a cron, like `WithQueue` and `WithPriority`
+func WithSendOptions(opts ...sendOptions) handlerOptions {
+	return func(h *ReceiverHandler) {
+		if h.schedule != nil {
+			h.schedule.send = append(h.schedule.send, opts...)
+		}
+	}
+}
+
+// NewCron creates a handler that also produces its own tasks: every tick of `spec` persists a task
+// whose payload is built by `factory`, then the task is handled like any other one.
+// The ticks are tracked in `task_schedules` so restarts or several instances never produce a tick twice.
+func NewCron[T any](spec string, factory func(tick time.Time) T, fn ReceiverFn[T], opts ...handlerOptions) (ReceiverHandler, error) {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return ReceiverHandler{}, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+	}
+
+	handler := NewHandler(fn)
+	handler.kind = Cron
+	handler.schedule = &cronSchedule{
+		spec:     spec,
+		schedule: schedule,
+		location: time.Local,
+		missed:   SkipMissed,
+		factory:  reflect.ValueOf(factory),
+	}
+	for _, v := range opts {
+		v(&handler)
+	}
+
+	return handler, nil
+}
+
+// ticks returns the ticks after `last` up to `now` that have to become tasks
+func (c *cronSchedule) ticks(last time.Time, now time.Time) []time.Time {
+	ticks := cron.Ticks(c.schedule, c.location, last, now, maxCatchUp)
+	if c.missed == SkipMissed && len(ticks) > 1 {
+		ticks = ticks[len(ticks)-1:]
+	}
+	return ticks
+}
+
+// materialize persists a task for each due tick of the registered crons
+func (t *TasksMiddleware) materialize(now time.Time) error {
+	t.receiversMu.RLock()
+	crons := make([]ReceiverHandler, 0, len(t.crons))
+	for _, name := range t.crons {
+		crons = append(crons, t.receivers[name])
+	}
+	t.receiversMu.RUnlock()
+
+	for _, receiver := range crons {
+		if err := t.materializeCron(receiver, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TasksMiddleware) materializeCron(receiver ReceiverHandler, now time.Time) error {
+	name := receiver.taskName
+	schedule := receiver.schedule
+
+	due := func(last time.Time) []time.Time {
+		ticks := schedule.ticks(last, now)
+		if len(ticks) >= maxCatchUp {
+			slog.Warn("cron catch up reached its limit, older ticks are dropped", slog.String("type", name), slog.Int("ticks", len(ticks)))
+		}
+		return ticks
+	}
+	return cron.Materialize(t.muxdb, "task_schedules", name, schedule.spec, now, due, func(tx *sql.Tx, ticks []time.Time) error {
+		for _, tick := range ticks {
+			var payload any
+			if err := protect(func() error {
+				payload = schedule.factory.Call([]reflect.Value{reflect.ValueOf(tick)})[0].Interface()
+				return nil
+			}); err != nil {
+				return fmt.Errorf("cron factory of %v failed: %w", name, err)
+			}
+			config := newSendConfig(schedule.send...)
+			config.runAt = &tick
+			config.version = receiver.version
+			if _, err := t.insertTask(tx, name, payload, config); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -30,6 +30,8 @@ var (
 	Completed State = "completed"
 	// Job is waiting for an external signal
 	WaitSignal State = "wait_signal"
+	// Job has no handler, it is enqueued again once one registers
+	Parked State = "parked"
 )
 
 // A job can contain any payload and can be hard deleted.
@@ -43,4 +45,25 @@ type Task[T any] struct {
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at"`
 	Error     *string    `json:"error"`
+	// Amount of times the task was run and failed
+	Attempts int `json:"attempts"`
+	// When the task is due, nil means as soon as possible
+	RunAt *time.Time `json:"run_at"`
+	Queue string     `json:"queue"`
+	// Higher runs first within its queue
+	Priority int `json:"priority"`
+	// Version of the payload when it was stored
+	PayloadVersion int `json:"payload_version"`
+}
+
+// Columns scanned by `queryTasks`
+const taskColumns = `id, type, status, created_at, updated_at, payload, error, attempts, run_at, queue, priority, payload_version`
+
+// What a context-aware handler knows about the task it runs
+type TaskInfo struct {
+	ID   int64
+	Type string
+	// Current attempt, starting at 1
+	Attempt   int
+	CreatedAt time.Time
 }
@@ -0,0 +1,196 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// One failed attempt of a task
+type TaskFailure struct {
+	ID       int64     `json:"id"`
+	TaskID   int64     `json:"task_id"`
+	Attempt  int       `json:"attempt"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Filters of the archived tasks, the zero value matches all of them
+type ArchivedFilter struct {
+	Type string
+	// Archived at or after
+	From time.Time
+	// Archived before
+	To time.Time
+	// Part of the last error
+	ErrorContains string
+
+	Offset int
+	// 50 when unset
+	Limit int
+}
+
+const defaultArchivedLimit = 50
+
+func (f ArchivedFilter) where() (string, []any) {
+	conditions := []string{`status = ?`}
+	args := []any{Archived}
+
+	if f.Type != "" {
+		conditions = append(conditions, `type = ?`)
+		args = append(args, f.Type)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, `updated_at >= ?`)
+		args = append(args, f.From.UnixNano())
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, `updated_at < ?`)
+		args = append(args, f.To.UnixNano())
+	}
+	if f.ErrorContains != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.ErrorContains)
+		conditions = append(conditions, `error LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escaped+"%")
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// GetArchivedTasks lists the archived tasks matching the filter, the most recently archived first
+func (t *TasksMiddleware) GetArchivedTasks(filter ArchivedFilter) ([]Task[any], error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultArchivedLimit
+	}
+
+	where, args := filter.where()
+	args = append(args, limit, filter.Offset)
+
+	return t.queryTasks(`SELECT `+taskColumns+` FROM jobs WHERE `+where+` ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?`, args...)
+}
+
+// CountArchivedTasks counts the archived tasks matching the filter, pagination aside
+func (t *TasksMiddleware) CountArchivedTasks(filter ArchivedFilter) (int64, error) {
+	var count int64
+	where, args := filter.where()
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		return db.QueryRow(t.muxdb.Rebind(`SELECT COUNT(*) FROM jobs WHERE `+where), args...).Scan(&count)
+	})
+	return count, err
+}
+
+// Requeue enqueues archived tasks again with a fresh amount of attempts, their failure history is kept
+func (t *TasksMiddleware) Requeue(ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{Enqueued, time.Now().UnixNano(), Archived}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	var requeued int64
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		result, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, attempts = 0, error = NULL, run_at = NULL, worker_id = NULL, lease_until = NULL WHERE status = ? AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`), args...)
+		if err != nil {
+			return err
+		}
+		requeued, err = result.RowsAffected()
+		return err
+	})
+	return requeued, err
+}
+
+// RequeueArchived requeues every archived task matching the filter, pagination aside
+func (t *TasksMiddleware) RequeueArchived(filter ArchivedFilter) (int64, error) {
+	where, args := filter.where()
+	args = append([]any{Enqueued, time.Now().UnixNano()}, args...)
+
+	var requeued int64
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		result, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, attempts = 0, error = NULL, run_at = NULL, worker_id = NULL, lease_until = NULL WHERE `+where), args...)
+		if err != nil {
+			return err
+		}
+		requeued, err = result.RowsAffected()
+		return err
+	})
+	return requeued, err
+}
+
+// Purge deletes archived tasks with their failure history
+func (t *TasksMiddleware) Purge(ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{Archived}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	return t.purge(`status = ? AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args)
+}
+
+// PurgeArchived deletes every archived task matching the filter, pagination aside
+func (t *TasksMiddleware) PurgeArchived(filter ArchivedFilter) (int64, error) {
+	where, args := filter.where()
+	return t.purge(where, args)
+}
+
+func (t *TasksMiddleware) purge(where string, args []any) (int64, error) {
+	var purged int64
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(t.muxdb.Rebind(`DELETE FROM task_failures WHERE task_id IN (SELECT id FROM jobs WHERE `+where+`)`), args...); err != nil {
+			return err
+		}
+		result, err := tx.Exec(t.muxdb.Rebind(`DELETE FROM jobs WHERE `+where), args...)
+		if err != nil {
+			return err
+		}
+		if purged, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	return purged, err
+}
+
+// GetTaskFailures returns every failed attempt of a task, the oldest first
+func (t *TasksMiddleware) GetTaskFailures(taskID int64) ([]TaskFailure, error) {
+	failures := []TaskFailure{}
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`SELECT id, task_id, attempt, error, failed_at FROM task_failures WHERE task_id = ? ORDER BY id`), taskID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			failure := TaskFailure{}
+			var failedAt int64
+			if err := rows.Scan(&failure.ID, &failure.TaskID, &failure.Attempt, &failure.Error, &failedAt); err != nil {
+				return err
+			}
+			failure.FailedAt = time.Unix(0, failedAt)
+			failures = append(failures, failure)
+		}
+		return rows.Err()
+	})
+	return failures, err
+}
+
+func (t *TasksMiddleware) recordFailure(tx *sql.Tx, taskID int64, attempt int, failure string, at time.Time) error {
+	_, err := tx.Exec(t.muxdb.Rebind(`INSERT INTO task_failures (task_id, attempt, error, failed_at) VALUES (?, ?, ?, ?)`), taskID, attempt, failure, at.UnixNano())
+	return err
+}
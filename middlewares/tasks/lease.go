@@ -0,0 +1,154 @@
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// How long a claimed task belongs to its worker without news from it, 30s by default.
+// The lease is renewed while the handler runs so only a dead worker loses its tasks.
+func WithLease(lease time.Duration) schedulerOptions {
+	return func(c *schedulerConfig) {
+		if lease > 0 {
+			c.lease = lease
+		}
+	}
+}
+
+// Identity written on the claimed tasks, `hostname-pid-random` by default so it changes with each process.
+// A stable one is needed for a restarted worker to recover its tasks right away,
+// otherwise the tasks whose lease didn't expire yet wait for it like the ones of any other worker.
+func WithWorkerID(id string) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.workerID = id
+	}
+}
+
+func defaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// renew extends the lease of an active task until the returned function is called
+func (t *TasksMiddleware) renew(task Task[any]) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(t.schedulerConfig.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := t.muxdb.Do(func(db *sql.DB) error {
+					_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET lease_until = ? WHERE id = ? AND status = ? AND worker_id = ?`), time.Now().Add(t.schedulerConfig.lease).UnixNano(), task.ID, Active, t.schedulerConfig.workerID)
+					return err
+				}); err != nil {
+					slog.Error("task lease renewal failed", slog.Int64("id", task.ID), slog.Any("error", err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// reap gives back the tasks whose lease expired, their worker is gone
+func (t *TasksMiddleware) reap(now time.Time) error {
+	return t.giveBack("lease expired", `lease_until < ?`, now.UnixNano())
+}
+
+// recoverStranded gives back the tasks claimed by a previous run of this worker, only possible with `WithWorkerID`,
+// and the ones of any worker whose lease already expired
+func (t *TasksMiddleware) recoverStranded() error {
+	if err := t.giveBack("worker restarted", `worker_id = ?`, t.schedulerConfig.workerID); err != nil {
+		return err
+	}
+	return t.reap(time.Now())
+}
+
+// giveBack puts the stranded tasks matching `condition` back in the queue.
+// A pending task never started so it is simply enqueued again, an active one counts as a failed attempt
+// and is retried after the backoff of its retry policy, unless the policy is exhausted (`NoRetry` archives it right away).
+func (t *TasksMiddleware) giveBack(reason string, condition string, args ...any) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		now := time.Now().UnixNano()
+
+		if _, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, worker_id = NULL, lease_until = NULL WHERE status = ? AND `+condition), append([]any{Enqueued, now, Pending}, args...)...); err != nil {
+			return err
+		}
+
+		rows, err := db.Query(t.muxdb.Rebind(`SELECT id, type, attempts FROM jobs WHERE status = ? AND `+condition), append([]any{Active}, args...)...)
+		if err != nil {
+			return err
+		}
+		stranded := []Task[any]{}
+		for rows.Next() {
+			task := Task[any]{}
+			if err := rows.Scan(&task.ID, &task.Type, &task.Attempts); err != nil {
+				rows.Close()
+				return err
+			}
+			stranded = append(stranded, task)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, task := range stranded {
+			attempts := task.Attempts + 1
+			state := Retry
+			var runAt any
+			// without a receiver there is no policy to apply, the task is given back as it is
+			if receiver, ok := t.receiver(task.Type); ok {
+				if attempts >= receiver.retry.MaxAttempts {
+					state = Archived
+				} else {
+					runAt = time.Unix(0, now).Add(receiver.retry.Backoff(attempts)).UnixNano()
+				}
+			}
+			tx, err := db.BeginTx(context.Background(), nil)
+			if err != nil {
+				return err
+			}
+			result, err := tx.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, error = ?, attempts = ?, run_at = ?, worker_id = NULL, lease_until = NULL WHERE id = ? AND status = ? AND `+condition), append([]any{state, now, reason, attempts, runAt, task.ID, Active}, args...)...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			// renewed in the meantime, its worker is alive after all
+			if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+				tx.Rollback()
+				continue
+			}
+			if err := t.recordFailure(tx, task.ID, attempts, reason, time.Unix(0, now)); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			slog.Warn("stranded task given back", slog.Int64("id", task.ID), slog.String("type", task.Type), slog.String("reason", reason), slog.String("state", string(state)))
+		}
+
+		return nil
+	})
+}
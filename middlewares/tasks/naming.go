@@ -0,0 +1,97 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Upgrader turns a payload stored by the previous version into the next version
+type Upgrader func(payload json.RawMessage) (json.RawMessage, error)
+
+// Name stored with the tasks of the handler, the name of the Go type by default.
+// An explicit name survives a rename of the struct and avoids collisions between packages.
+func WithName(name string) handlerOptions {
+	return func(h *ReceiverHandler) {
+		h.taskName = name
+	}
+}
+
+// Version of the payload the handler decodes, 1 by default.
+// Stored tasks of an older version go through the upgraders before being decoded.
+func WithVersion(version int) handlerOptions {
+	return func(h *ReceiverHandler) {
+		h.version = version
+	}
+}
+
+// Upgrader of the payloads of version `from` to version `from+1`
+func WithUpgrader(from int, upgrader Upgrader) handlerOptions {
+	return func(h *ReceiverHandler) {
+		if h.upgraders == nil {
+			h.upgraders = map[int]Upgrader{}
+		}
+		h.upgraders[from] = upgrader
+	}
+}
+
+func (h ReceiverHandler) validate() error {
+	if h.taskName == "" {
+		return fmt.Errorf("the type %v has no name, give one with `WithName`", h.consumerType)
+	}
+	if h.version < 1 {
+		return fmt.Errorf("the version of %v must be at least 1", h.taskName)
+	}
+	for from := 1; from < h.version; from++ {
+		if _, ok := h.upgraders[from]; !ok {
+			return fmt.Errorf("%v has no upgrader from the version %d to %d", h.taskName, from, from+1)
+		}
+	}
+	// without a context the handler can't be interrupted
+	if h.timeout > 0 && !h.withContext {
+		return fmt.Errorf("%v can't have a timeout, create it with `NewContextHandler`", h.taskName)
+	}
+	return nil
+}
+
+// decode upgrades a stored payload to the version of the handler then decodes it into its type
+func (h ReceiverHandler) decode(payload []byte, version int) (any, error) {
+	if version > h.version {
+		return nil, fmt.Errorf("%v payload of version %d is newer than its handler (%d)", h.taskName, version, h.version)
+	}
+	for ; version < h.version; version++ {
+		upgraded, err := h.upgraders[version](payload)
+		if err != nil {
+			return nil, fmt.Errorf("%v payload upgrade from the version %d failed: %w", h.taskName, version, err)
+		}
+		payload = upgraded
+	}
+
+	paramInstancePtr := reflect.New(h.consumerType).Interface()
+	//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
+	if err := json.Unmarshal(payload, paramInstancePtr); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(paramInstancePtr).Elem().Interface(), nil
+}
+
+// taskName resolves the name and version stored for a payload, the ones of its handler when registered
+func (t *TasksMiddleware) taskName(payload any) (string, int, error) {
+	payloadType := reflect.TypeOf(payload)
+
+	t.receiversMu.RLock()
+	name, ok := t.names[payloadType]
+	var receiver ReceiverHandler
+	if ok {
+		receiver = t.receivers[name]
+	}
+	t.receiversMu.RUnlock()
+
+	if ok {
+		return name, receiver.version, nil
+	}
+	if payloadType.Name() == "" {
+		return "", 0, fmt.Errorf("the type %v has no name, register its handler `WithName` first", payloadType)
+	}
+	return payloadType.Name(), 1, nil
+}
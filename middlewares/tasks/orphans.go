@@ -0,0 +1,125 @@
+package tasks
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// What the scheduler does with the tasks whose type has no handler
+type OrphanPolicy string
+
+var (
+	// The tasks stay as they are and run as soon as a handler registers
+	LeaveOrphans OrphanPolicy = "leave"
+	// The tasks are moved to `Parked`, registering their handler enqueues them again.
+	// So does the next beat of any instance with their handler, the instances can have different handlers.
+	ParkOrphans OrphanPolicy = "park"
+)
+
+// Policy for the tasks without handler, `LeaveOrphans` by default
+func WithOrphans(policy OrphanPolicy) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.orphans = policy
+	}
+}
+
+const defaultOrphansLimit = 50
+
+// registeredTypes returns the names of the handlers and a placeholder for each of them
+func (t *TasksMiddleware) registeredTypes() ([]any, string) {
+	t.receiversMu.RLock()
+	defer t.receiversMu.RUnlock()
+	types := make([]any, 0, len(t.receivers))
+	for name := range t.receivers {
+		types = append(types, name)
+	}
+	if len(types) == 0 {
+		return types, ""
+	}
+	return types, `?` + strings.Repeat(", ?", len(types)-1)
+}
+
+// handledVersions matches the tasks of the registered handlers whose payload version they can decode
+func (t *TasksMiddleware) handledVersions() (string, []any) {
+	t.receiversMu.RLock()
+	defer t.receiversMu.RUnlock()
+	conditions := make([]string, 0, len(t.receivers))
+	args := make([]any, 0, len(t.receivers)*2)
+	for name, receiver := range t.receivers {
+		conditions = append(conditions, `(type = ? AND payload_version <= ?)`)
+		args = append(args, name, receiver.version)
+	}
+	return strings.Join(conditions, " OR "), args
+}
+
+// orphansWhere matches the tasks of the given states whose type has no handler
+func (t *TasksMiddleware) orphansWhere(states ...State) (string, []any) {
+	args := []any{}
+	for _, state := range states {
+		args = append(args, state)
+	}
+	where := `status IN (?` + strings.Repeat(", ?", len(states)-1) + `)`
+	types, placeholders := t.registeredTypes()
+	if len(types) > 0 {
+		where += ` AND type NOT IN (` + placeholders + `)`
+		args = append(args, types...)
+	}
+	return where, args
+}
+
+// GetOrphanedTasks lists the waiting tasks whose type has no handler, the oldest first, 50 when `limit` is 0 or less
+func (t *TasksMiddleware) GetOrphanedTasks(limit int) ([]Task[any], error) {
+	if limit <= 0 {
+		limit = defaultOrphansLimit
+	}
+	where, args := t.orphansWhere(Enqueued, Retry, Parked)
+	return t.queryTasks(`SELECT `+taskColumns+` FROM jobs WHERE `+where+` ORDER BY created_at, id LIMIT ?`, append(args, limit)...)
+}
+
+// Amount of orphaned tasks seen by the last beat of the scheduler
+func (t *TasksMiddleware) MetricOrphanedTasks() int64 {
+	return t.metricOrphanedTasks.Load()
+}
+
+// watchOrphans enqueues again the parked tasks this instance handles, counts the orphaned tasks,
+// warns when there are new ones and parks them if asked to.
+// Parking doesn't change the count, it happens last so a parked task is always in the metric.
+func (t *TasksMiddleware) watchOrphans() error {
+	// parked by an instance without their handler
+	if types, _ := t.registeredTypes(); len(types) > 0 {
+		if err := t.adopt(types...); err != nil {
+			return err
+		}
+	}
+
+	var count int64
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		where, args := t.orphansWhere(Enqueued, Retry, Parked)
+		return db.QueryRow(t.muxdb.Rebind(`SELECT COUNT(*) FROM jobs WHERE `+where), args...).Scan(&count)
+	}); err != nil {
+		return err
+	}
+
+	if previous := t.metricOrphanedTasks.Swap(count); count > previous {
+		slog.Warn("tasks without handler are waiting", slog.Int64("orphans", count))
+	}
+
+	if t.schedulerConfig.orphans != ParkOrphans {
+		return nil
+	}
+	return t.muxdb.Do(func(db *sql.DB) error {
+		where, args := t.orphansWhere(Enqueued, Retry)
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ? WHERE `+where), append([]any{Parked, time.Now().UnixNano()}, args...)...)
+		return err
+	})
+}
+
+// adopt enqueues again the parked tasks of handlers that just registered
+func (t *TasksMiddleware) adopt(types ...any) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ? WHERE status = ? AND type IN (?`+strings.Repeat(", ?", len(types)-1)+`)`), append([]any{Enqueued, time.Now().UnixNano(), Parked}, types...)...)
+		return err
+	})
+}
@@ -0,0 +1,78 @@
+package tasks
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/data/datatest"
+	"github.com/davidroman0O/sql-toolbox/migrations"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the postgres statements")
+
+// The statements sent to postgres, rebound and with their conflict clauses, without a server.
+// Nothing is ever found so each call stops at its first lookup, `go test -run TestPostgresStatements -update` rewrites them.
+func TestPostgresStatements(t *testing.T) {
+	recorder := datatest.NewRecorder(data.Postgres)
+	muxdb := recorder.MuxDb()
+	middleware := New(WithWorkerID("worker"))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+	middleware.muxdb = muxdb
+
+	if err := middleware.Register(NewHandler[PingMsg](func() func(data PingMsg) error {
+		return func(data PingMsg) error {
+			return nil
+		}
+	})); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := NewCron[DigestMsg]("@every 1m", func(tick time.Time) DigestMsg {
+		return DigestMsg{Tick: tick.Unix()}
+	}, func() func(data DigestMsg) error {
+		return func(data DigestMsg) error {
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.Register(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	task := Task[any]{ID: 1, Type: "PingMsg", State: Enqueued, Payload: PingMsg{Msg: "ping"}}
+	filter := ArchivedFilter{Type: "PingMsg", ErrorContains: "timeout"}
+
+	// the errors are expected, the recorder has no rows to return
+	for _, call := range []func() error{
+		func() error { return middleware.Send(PingMsg{Msg: "ping"}, WithQueue("critical"), WithPriority(1)) },
+		func() error {
+			return middleware.Send(PingMsg{Msg: "ping"}, WithUniqueKey("ping"), WithUniqueFor(time.Minute))
+		},
+		func() error { return middleware.materialize(time.Now()) },
+		func() error { return middleware.watchOrphans() },
+		func() error { _, err := middleware.getDueTasks(); return err },
+		func() error { _, err := middleware.claim(task); return err },
+		func() error { return middleware.fail(task, fmt.Errorf("unavailable")) },
+		func() error { return middleware.archiveUndecodable(task, fmt.Errorf("cannot unmarshal")) },
+		func() error { return middleware.unclaim(task) },
+		func() error { return middleware.reap(time.Now()) },
+		func() error { return middleware.recoverStranded() },
+		func() error { _, err := middleware.GetArchivedTasks(filter); return err },
+		func() error { _, err := middleware.Requeue(1, 2); return err },
+		func() error { _, err := middleware.RequeueArchived(filter); return err },
+		func() error { _, err := middleware.PurgeArchived(filter); return err },
+		func() error { _, err := middleware.GetTaskFailures(1); return err },
+		func() error { _, err := middleware.GetOrphanedTasks(10); return err },
+	} {
+		call()
+	}
+
+	recorder.Golden(t, "testdata/postgres.golden", *update)
+}
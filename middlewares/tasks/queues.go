@@ -0,0 +1,112 @@
+package tasks
+
+import (
+	"sort"
+	"time"
+)
+
+const DefaultQueue = "default"
+
+type sendConfig struct {
+	queue    string
+	priority int
+	runAt    *time.Time
+	// payload version of the handler
+	version int
+
+	uniqueKey     string
+	uniquePayload bool
+	uniqueFor     time.Duration
+	conflict      ConflictPolicy
+}
+
+type sendOptions func(*sendConfig)
+
+// Queue of the task, `DefaultQueue` when unset
+func WithQueue(queue string) sendOptions {
+	return func(c *sendConfig) {
+		if queue != "" {
+			c.queue = queue
+		}
+	}
+}
+
+// Priority of the task within its queue, the higher runs first, 0 by default
+func WithPriority(priority int) sendOptions {
+	return func(c *sendConfig) {
+		c.priority = priority
+	}
+}
+
+// When the task is due, as soon as possible by default
+func WithRunAt(at time.Time) sendOptions {
+	return func(c *sendConfig) {
+		c.runAt = &at
+	}
+}
+
+func newSendConfig(opts ...sendOptions) sendConfig {
+	config := sendConfig{
+		queue:    DefaultQueue,
+		conflict: ConflictReturnExisting,
+		version:  1,
+	}
+	for _, v := range opts {
+		v(&config)
+	}
+	return config
+}
+
+// Share of the workers given to each queue when several have due tasks, a queue not listed weighs 1.
+// With `{"emails": 3, "reports": 1}` three emails are claimed for each report.
+func WithQueueWeights(weights map[string]int) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.weights = weights
+	}
+}
+
+func (c schedulerConfig) weight(queue string) int {
+	if weight, ok := c.weights[queue]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// nextQueue picks the queue of the next claim among the ones having tasks left with a smooth weighted round robin,
+// the credits are kept between beats so the sharing holds even when a beat only claims a few tasks
+func (t *TasksMiddleware) nextQueue(due map[string][]Task[any]) (string, bool) {
+	queues := make([]string, 0, len(due))
+	for queue, tasks := range due {
+		if len(tasks) > 0 {
+			queues = append(queues, queue)
+		}
+	}
+	if len(queues) == 0 {
+		return "", false
+	}
+	sort.Strings(queues)
+
+	t.creditsMu.Lock()
+	defer t.creditsMu.Unlock()
+
+	total := 0
+	picked := ""
+	for _, queue := range queues {
+		weight := t.schedulerConfig.weight(queue)
+		total += weight
+		t.credits[queue] += weight
+		if picked == "" || t.credits[queue] > t.credits[picked] {
+			picked = queue
+		}
+	}
+	t.credits[picked] -= total
+
+	return picked, true
+}
+
+// available tells if a worker is free for another claim
+func (t *TasksMiddleware) available() bool {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	return t.running < t.schedulerConfig.workers
+}
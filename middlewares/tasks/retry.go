@@ -0,0 +1,109 @@
+package tasks
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy tells the scheduler what to do with a task whose handler returned an error
+type RetryPolicy struct {
+	// Total amount of attempts, the first run included. 1 or less never retries.
+	MaxAttempts int
+	// Delay before the first retry
+	InitialBackoff time.Duration
+	// Upper bound of the delay, 0 for none
+	MaxBackoff time.Duration
+	// Growth of the delay between two retries, 2 when unset
+	Multiplier float64
+	// Fraction of the delay randomized (0.2 = ±20%) so failed tasks don't retry all at once
+	Jitter float64
+	// Errors for which retrying is pointless, in addition to the ones wrapped with `Permanent`
+	NonRetryable func(err error) bool
+}
+
+// Default policy of the handlers, a failed task is archived right away
+func NoRetry() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 1,
+	}
+}
+
+// Exponential backoff starting at `initial`, capped at `max`, with 20% of jitter
+func ExponentialBackoff(maxAttempts int, initial time.Duration, max time.Duration) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initial,
+		MaxBackoff:     max,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Backoff returns the delay before running the task again after its `attempt`-th failure (starting at 1)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	if delay < 0 {
+		return 0
+	}
+
+	return time.Duration(delay)
+}
+
+// Retryable tells if a task that failed its `attempt`-th time with `err` should be retried
+func (p RetryPolicy) Retryable(err error, attempt int) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if IsPermanent(err) {
+		return false
+	}
+	if p.NonRetryable != nil && p.NonRetryable(err) {
+		return false
+	}
+	return true
+}
+
+// Retry policy of the tasks handled by that handler, `NoRetry` by default
+func WithRetryPolicy(policy RetryPolicy) handlerOptions {
+	return func(h *ReceiverHandler) {
+		h.retry = policy
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error returned by a handler as non-retryable, the task is archived right away
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
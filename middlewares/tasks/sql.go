@@ -0,0 +1,184 @@
+package tasks
+
+import (
+	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/migrations"
+)
+
+const namespace = "tasks"
+
+func (l *TasksMiddleware) Migrations() []migrations.Migration {
+	return []migrations.Migration{
+		{
+			Namespace: namespace,
+			Version:   1,
+			Name:      "create jobs table",
+			// `IF NOT EXISTS` adopts the tables created before the migrations existed
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'enqueued',
+	created_at INTEGER,
+	updated_at INTEGER NULL,
+	payload JSON,
+	error TEXT NULL
+);
+`),
+				data.Postgres: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'enqueued',
+	created_at BIGINT,
+	updated_at BIGINT NULL,
+	payload JSON,
+	error TEXT NULL
+);
+`),
+			}),
+			Down: migrations.SQL(`DROP TABLE IF EXISTS jobs;`),
+		},
+		{
+			Namespace: namespace,
+			Version:   2,
+			Name:      "add attempts and run_at for retries",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE jobs ADD COLUMN run_at INTEGER NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs (status, run_at);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+					`ALTER TABLE jobs ADD COLUMN run_at BIGINT NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs (status, run_at);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS jobs_status_run_at;`,
+				`ALTER TABLE jobs DROP COLUMN run_at;`,
+				`ALTER TABLE jobs DROP COLUMN attempts;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   3,
+			Name:      "create task_schedules table",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS task_schedules (
+	name TEXT PRIMARY KEY,
+	spec TEXT NOT NULL,
+	last_tick INTEGER NOT NULL
+);
+`),
+				data.Postgres: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS task_schedules (
+	name TEXT PRIMARY KEY,
+	spec TEXT NOT NULL,
+	last_tick BIGINT NOT NULL
+);
+`),
+			}),
+			Down: migrations.SQL(`DROP TABLE IF EXISTS task_schedules;`),
+		},
+		{
+			Namespace: namespace,
+			Version:   4,
+			Name:      "add lease_until and worker_id for leases",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN lease_until INTEGER NULL;`,
+					`ALTER TABLE jobs ADD COLUMN worker_id TEXT NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_status_lease_until ON jobs (status, lease_until);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN lease_until BIGINT NULL;`,
+					`ALTER TABLE jobs ADD COLUMN worker_id TEXT NULL;`,
+					`CREATE INDEX IF NOT EXISTS jobs_status_lease_until ON jobs (status, lease_until);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS jobs_status_lease_until;`,
+				`ALTER TABLE jobs DROP COLUMN worker_id;`,
+				`ALTER TABLE jobs DROP COLUMN lease_until;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   5,
+			Name:      "create task_failures table",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS task_failures (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	attempt INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	failed_at INTEGER NOT NULL
+);
+`,
+					`CREATE INDEX IF NOT EXISTS task_failures_task_id ON task_failures (task_id);`,
+				),
+				data.Postgres: migrations.SQL(`
+CREATE TABLE IF NOT EXISTS task_failures (
+	id BIGSERIAL PRIMARY KEY,
+	task_id BIGINT NOT NULL,
+	attempt INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	failed_at BIGINT NOT NULL
+);
+`,
+					`CREATE INDEX IF NOT EXISTS task_failures_task_id ON task_failures (task_id);`,
+				),
+			}),
+			Down: migrations.SQL(`DROP TABLE IF EXISTS task_failures;`),
+		},
+		{
+			Namespace: namespace,
+			Version:   6,
+			Name:      "add queue and priority",
+			Up: migrations.SQL(
+				`ALTER TABLE jobs ADD COLUMN queue TEXT NOT NULL DEFAULT 'default';`,
+				`ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;`,
+				`CREATE INDEX IF NOT EXISTS jobs_status_queue_priority ON jobs (status, queue, priority);`,
+			),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS jobs_status_queue_priority;`,
+				`ALTER TABLE jobs DROP COLUMN priority;`,
+				`ALTER TABLE jobs DROP COLUMN queue;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   7,
+			Name:      "add unique_key for idempotent enqueue",
+			Up: migrations.ForDialect(map[data.Dialect]migrations.Step{
+				data.SQLite: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN unique_key TEXT NULL;`,
+					`ALTER TABLE jobs ADD COLUMN unique_until INTEGER NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS jobs_unique_key ON jobs (unique_key);`,
+				),
+				data.Postgres: migrations.SQL(
+					`ALTER TABLE jobs ADD COLUMN unique_key TEXT NULL;`,
+					`ALTER TABLE jobs ADD COLUMN unique_until BIGINT NULL;`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS jobs_unique_key ON jobs (unique_key);`,
+				),
+			}),
+			Down: migrations.SQL(
+				`DROP INDEX IF EXISTS jobs_unique_key;`,
+				`ALTER TABLE jobs DROP COLUMN unique_until;`,
+				`ALTER TABLE jobs DROP COLUMN unique_key;`,
+			),
+		},
+		{
+			Namespace: namespace,
+			Version:   8,
+			Name:      "add payload_version",
+			Up:        migrations.SQL(`ALTER TABLE jobs ADD COLUMN payload_version INTEGER NOT NULL DEFAULT 1;`),
+			Down:      migrations.SQL(`ALTER TABLE jobs DROP COLUMN payload_version;`),
+		},
+	}
+}
@@ -4,15 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"time"
 
 	"reflect"
+	"sync"
+	"sync/atomic"
 
 	"github.com/davidroman0O/sql-toolbox/data"
-	"github.com/mattn/go-sqlite3"
 )
 
 /// This middleware can be used to preemptively store tasks in the database
@@ -20,30 +22,40 @@ import (
 /// - when tasks are sent, they are stored in the database, then a scheduler will get those tasks and send them to their channel
 /// - you can tweak the scheduler
 ///
-/// This middleware doesn't provide workers, nor scaling solution nor retries, it's just a simple way to store tasks in the database.
+/// - failed tasks can be retried with a `RetryPolicy` given to their handler
+/// - tasks can be delayed with `SendAt` and `SendAfter`
+/// - recurring tasks can be registered with `NewCron`
+/// - claimed tasks are executed by a pool of workers, see `WithWorkers` and `WithConcurrency`
+/// - a panicking handler fails its task with the stack trace, the workers keep running
+/// - tasks can be sent to named queues with a priority, the queues share the workers by weight, see `WithQueueWeights`
+/// - tasks can be sent within your own transaction with `SendTx`, they only exist once it commits
+/// - handlers can have an explicit name and versioned payloads, see `WithName`, `WithVersion` and `WithUpgrader`
+/// - tasks without handler wait or get parked until one registers, see `WithOrphans` and `GetOrphanedTasks`
+/// - duplicates can be avoided with a unique key, see `WithUniqueKey` and `WithUniquePayload`
+/// - archived tasks can be inspected, requeued and purged, see `GetArchivedTasks`
+/// - handlers created with `NewContextHandler` are cancelled on close and can have a timeout
+/// - claimed tasks are leased, the tasks of a crashed worker are given back once their lease expires, see `WithLease`
+///   and `WithWorkerID` for a restarted worker to take its own back right away
+///
+/// This middleware doesn't provide a scaling solution, it's just a simple way to store tasks in the database.
 /// You will be able to then plugin any kind of other data processing system to handle those tasks.
 ///
 /// I have a personal preference to use [`watermill`](https://github.com/ThreeDotsLabs/watermill/) or [`goakt`](https://github.com/Tochemey/goakt) to process my tasks, but you can use any other system you want.
 ///
 
-var jobsTable = `
-CREATE TABLE IF NOT EXISTS jobs (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	type TEXT NOT NULL,
-	status TEXT NOT NULL DEFAULT 'enqueued',
-	created_at INTEGER,
-	updated_at INTEGER NULL,
-	payload JSON,
-	error TEXT NULL
-);
-`
-
 func New(opts ...schedulerOptions) *TasksMiddleware {
 	task := &TasksMiddleware{
 		receivers: map[string]ReceiverHandler{},
+		names:     map[reflect.Type]string{},
+		inflight:  map[string]int{},
+		credits:   map[string]int{},
 		schedulerConfig: schedulerConfig{
-			ticker: time.Millisecond * 100,
-			limit:  10,
+			ticker:   time.Millisecond * 100,
+			limit:    10,
+			workers:  1,
+			lease:    time.Second * 30,
+			shutdown: time.Second * 10,
+			orphans:  LeaveOrphans,
 		},
 	}
 
@@ -51,12 +63,22 @@ func New(opts ...schedulerOptions) *TasksMiddleware {
 		v(&task.schedulerConfig)
 	}
 
+	if task.schedulerConfig.workerID == "" {
+		task.schedulerConfig.workerID = defaultWorkerID()
+	}
+
 	return task
 }
 
 type schedulerConfig struct {
-	ticker time.Duration
-	limit  int
+	ticker   time.Duration
+	limit    int
+	workers  int
+	lease    time.Duration
+	workerID string
+	shutdown time.Duration
+	weights  map[string]int
+	orphans  OrphanPolicy
 }
 
 func WithTicker(ticker time.Duration) schedulerOptions {
@@ -71,36 +93,84 @@ func WithLimit(limit int) schedulerOptions {
 	}
 }
 
+// Amount of tasks executed in parallel, 1 by default
+func WithWorkers(workers int) schedulerOptions {
+	return func(c *schedulerConfig) {
+		if workers > 0 {
+			c.workers = workers
+		}
+	}
+}
+
+// How long `OnClose` waits for the running handlers before cancelling their context, 10s by default
+func WithShutdownTimeout(timeout time.Duration) schedulerOptions {
+	return func(c *schedulerConfig) {
+		c.shutdown = timeout
+	}
+}
+
 type schedulerOptions func(*schedulerConfig)
 
 type TasksMiddleware struct {
 	schedulerConfig schedulerConfig
 	muxdb           *data.MuxDb
-	receivers       map[string]ReceiverHandler
-	doneScheduler   chan struct{}
+
+	receiversMu sync.RWMutex
+	receivers   map[string]ReceiverHandler
+	names       map[reflect.Type]string
+	crons       []string
+
+	// amount of claimed tasks per type that are not done yet
+	inflightMu sync.Mutex
+	inflight   map[string]int
+	running    int
+
+	metricOrphanedTasks atomic.Int64
+
+	// smooth weighted round robin state between the queues
+	creditsMu sync.Mutex
+	credits   map[string]int
+
+	// cancelled when the handlers didn't finish in time on close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	work             chan Task[any]
+	workers          sync.WaitGroup
+	doneScheduler    chan struct{}
+	stoppedScheduler chan struct{}
 }
 
 func (l *TasksMiddleware) OnInit(muxdb *data.MuxDb) error {
 	log.Println("Tasks middleware initialized")
+	if muxdb == nil {
+		return fmt.Errorf("tasks middleware requires a database")
+	}
+	// the tables are created by the migrations, see `Migrations`
 	l.muxdb = muxdb
-	if err := l.muxdb.Do(func(db *sql.DB) error {
-		tx, err := db.BeginTx(context.Background(), nil)
-		if err != nil {
-			return err
-		}
 
-		_, err = tx.Exec(jobsTable)
-		if err != nil {
-			tx.Rollback()
+	// whatever this worker or a dead one left behind will never finish
+	if err := l.recoverStranded(); err != nil {
+		return err
+	}
+
+	// handlers registered since the last run may have parked tasks waiting for them
+	if types, _ := l.registeredTypes(); len(types) > 0 {
+		if err := l.adopt(types...); err != nil {
 			return err
 		}
-		defer slog.Info("Task database initialized")
-		return tx.Commit()
-	}); err != nil {
-		return err
 	}
 
+	l.ctx, l.cancel = context.WithCancel(context.Background())
 	l.doneScheduler = make(chan struct{})
+	l.stoppedScheduler = make(chan struct{})
+	// claims never exceed the amount of workers, sending to it never blocks the scheduler
+	l.work = make(chan Task[any], l.schedulerConfig.workers)
+
+	for range l.schedulerConfig.workers {
+		l.workers.Add(1)
+		go l.worker()
+	}
 
 	go l.scheduler()
 	return nil
@@ -108,51 +178,163 @@ func (l *TasksMiddleware) OnInit(muxdb *data.MuxDb) error {
 
 func (l *TasksMiddleware) OnClose() error {
 	log.Println("Tasks middleware closed")
-	close(l.doneScheduler)
+	if l.doneScheduler != nil {
+		close(l.doneScheduler)
+		<-l.stoppedScheduler
+		// the workers finish the tasks already claimed before leaving
+		close(l.work)
+		defer l.cancel()
+		return l.drain()
+	}
 	return nil
 }
 
-func (l *TasksMiddleware) OnInsert(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+// drain waits for the workers, past the shutdown timeout the handlers are cancelled and given the same time to return
+func (l *TasksMiddleware) drain() error {
+	stopped := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(l.schedulerConfig.shutdown):
+	}
+
+	slog.Warn("tasks still running after the shutdown timeout, cancelling them")
+	l.cancel()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(l.schedulerConfig.shutdown):
+		// their lease will expire and another worker will pick them up
+		return fmt.Errorf("tasks handlers ignored the cancellation and are still running")
+	}
+}
+
+// The scheduler polls the table, we don't need any change
+func (l *TasksMiddleware) Subscriptions() []data.Subscription {
+	return []data.Subscription{}
+}
+
+func (l *TasksMiddleware) OnInsert(event data.ChangeEvent) error {
 	// slog.Info("inserted", slog.Any("db", db), slog.Any("table", table), slog.Any("rowid", rowid))
 	return nil
 }
 
-func (l *TasksMiddleware) OnUpdate(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+func (l *TasksMiddleware) OnUpdate(event data.ChangeEvent) error {
 	return nil
 }
 
-func (l *TasksMiddleware) OnDelete(conn *sqlite3.SQLiteConn, db string, table string, rowid int64) error {
+func (l *TasksMiddleware) OnDelete(event data.ChangeEvent) error {
 	return nil
 }
 
 type ReceiverFn[T any] func() func(data T) error
 
+// Same as `ReceiverFn` but the handler gets a context, cancelled on close or after its timeout, and the task metadata
+type ContextReceiverFn[T any] func() func(ctx context.Context, info TaskInfo, data T) error
+
 type ReceiverHandler struct {
 	consumer     reflect.Value
 	consumerType reflect.Type
 	kind         ReceiverKind
+	retry        RetryPolicy
+	// maximum amount of tasks of that type executed at once, 0 for no limit besides the amount of workers
+	concurrency int
+	// only for the `Cron` kind
+	schedule *cronSchedule
+	// the consumer takes a context and the `TaskInfo` before the payload
+	withContext bool
+	// deadline of each execution, 0 for none
+	timeout time.Duration
+	// stored as the type of the tasks
+	taskName string
+	// version of the payload the consumer expects
+	version   int
+	upgraders map[int]Upgrader
 }
 
-func NewHandler[T any](fn ReceiverFn[T]) ReceiverHandler {
+type handlerOptions func(*ReceiverHandler)
+
+// Maximum amount of tasks of that type executed at once, bounded by the amount of workers
+func WithConcurrency(concurrency int) handlerOptions {
+	return func(h *ReceiverHandler) {
+		h.concurrency = concurrency
+	}
+}
+
+// Deadline of each execution of a handler created with `NewContextHandler`, `Register` refuses the other handlers
+func WithTimeout(timeout time.Duration) handlerOptions {
+	return func(h *ReceiverHandler) {
+		h.timeout = timeout
+	}
+}
+
+func NewContextHandler[T any](fn ContextReceiverFn[T], opts ...handlerOptions) ReceiverHandler {
+	initializeState := fn()
+	handler := ReceiverHandler{
+		consumer:     reflect.ValueOf(initializeState),
+		consumerType: reflect.TypeFor[T](),
+		kind:         Receiver,
+		retry:        NoRetry(),
+		withContext:  true,
+		taskName:     reflect.TypeFor[T]().Name(),
+		version:      1,
+	}
+	for _, v := range opts {
+		v(&handler)
+	}
+	return handler
+}
+
+func NewHandler[T any](fn ReceiverFn[T], opts ...handlerOptions) ReceiverHandler {
 	initializeState := fn() // allowing the functon to initialize it's own local state
-	return ReceiverHandler{
+	handler := ReceiverHandler{
 		consumer:     reflect.ValueOf(initializeState),
 		consumerType: reflect.TypeFor[T](),
 		kind:         Receiver,
+		retry:        NoRetry(),
+		taskName:     reflect.TypeFor[T]().Name(),
+		version:      1,
 	}
+	for _, v := range opts {
+		v(&handler)
+	}
+	return handler
 }
 
 func (l *TasksMiddleware) Register(receiver ReceiverHandler) error {
-	if _, ok := l.receivers[receiver.consumerType.Name()]; ok {
+	if err := receiver.validate(); err != nil {
+		return err
+	}
+	l.receiversMu.Lock()
+	defer l.receiversMu.Unlock()
+	if _, ok := l.receivers[receiver.taskName]; ok {
 		return fmt.Errorf("that type already exists")
 	}
-	l.receivers[receiver.consumerType.Name()] = receiver
-	return nil
+	if name, ok := l.names[receiver.consumerType]; ok {
+		return fmt.Errorf("the type %v is already registered as %v", receiver.consumerType, name)
+	}
+	l.receivers[receiver.taskName] = receiver
+	l.names[receiver.consumerType] = receiver.taskName
+	if receiver.kind == Cron {
+		l.crons = append(l.crons, receiver.taskName)
+	}
+	// the tasks parked while it was missing can run now, before the start it is done by `OnInit`
+	if l.ctx == nil {
+		return nil
+	}
+	return l.adopt(receiver.taskName)
 }
 
 // the scheduler will search for tasks to be triggered
 func (l *TasksMiddleware) scheduler() {
-	ticker := time.NewTicker(time.Millisecond * 100)
+	defer close(l.stoppedScheduler)
+	ticker := time.NewTicker(l.schedulerConfig.ticker)
 	for {
 		select {
 		case <-l.doneScheduler:
@@ -161,56 +343,284 @@ func (l *TasksMiddleware) scheduler() {
 			return
 		case <-ticker.C:
 			if err := l.Beat(); err != nil {
-				slog.Error("scheduler beat failed %v", err)
+				slog.Error("scheduler beat failed", slog.Any("error", err))
 			}
 		}
 	}
 }
 
-func (t *TasksMiddleware) propagate(tasks []Task[any]) error {
-	for _, task := range tasks {
-		result := t.receivers[task.Type].consumer.Call([]reflect.Value{reflect.ValueOf(task.Payload)})
-		// var nextState State
-		// var err error
-		if !result[0].IsNil() {
-			if errCast, ok := result[0].Interface().(error); ok {
-				t.muxdb.Do(func(db *sql.DB) error {
-					if _, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = ?, error = ? WHERE id = ?`, Archived, time.Now().UnixNano(), errCast.Error(), task.ID); err != nil {
-						return err
-					}
-					return nil
-				})
-				continue
-			} else {
-				t.muxdb.Do(func(db *sql.DB) error {
-					if _, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = ?, error = ? WHERE id = ?`, Archived, time.Now().UnixNano(), "consumer function must return an error", task.ID); err != nil {
-						return err
-					}
-					return nil
-				})
-				return fmt.Errorf("consumer function must return an error")
+func (t *TasksMiddleware) receiver(name string) (ReceiverHandler, bool) {
+	t.receiversMu.RLock()
+	defer t.receiversMu.RUnlock()
+	receiver, ok := t.receivers[name]
+	return receiver, ok
+}
+
+func (t *TasksMiddleware) worker() {
+	defer t.workers.Done()
+	for task := range t.work {
+		// closing, the task goes back to the queue for the next run
+		if t.ctx.Err() != nil {
+			if err := t.unclaim(task); err != nil {
+				slog.Error("task unclaim failed", slog.Int64("id", task.ID), slog.Any("error", err))
 			}
-		} else {
-			t.muxdb.Do(func(db *sql.DB) error {
-				if _, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = ? WHERE id = ?`, Completed, time.Now().UnixNano(), task.ID); err != nil {
-					return err
-				}
-				return nil
-			})
+			t.release(task.Type)
+			continue
 		}
+		if err := t.execute(task); err != nil {
+			slog.Error("task execution failed", slog.Int64("id", task.ID), slog.String("type", task.Type), slog.Any("error", err))
+		}
+		t.release(task.Type)
 	}
-	return nil
+}
+
+// execute runs the handler of a claimed task outside of any database lock
+func (t *TasksMiddleware) execute(task Task[any]) error {
+	receiver, ok := t.receiver(task.Type)
+	if !ok {
+		return t.unclaim(task)
+	}
+
+	var started int64
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		now := time.Now()
+		result, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, lease_until = ? WHERE id = ? AND status = ? AND worker_id = ?`), Active, now.UnixNano(), now.Add(t.schedulerConfig.lease).UnixNano(), task.ID, Pending, t.schedulerConfig.workerID)
+		if err != nil {
+			return err
+		}
+		started, err = result.RowsAffected()
+		return err
+	}); err != nil {
+		return err
+	}
+	// the claim was lost in the meantime (its lease expired and another worker may have it), the handler must not run twice
+	if started == 0 {
+		return nil
+	}
+
+	stopRenewing := t.renew(task)
+	failure := protect(func() error {
+		return t.call(receiver, task)
+	})
+	stopRenewing()
+
+	if failure != nil {
+		// cancelled by the shutdown, it's not the handler's fault
+		if t.ctx.Err() != nil && errors.Is(failure, context.Canceled) {
+			return t.unclaim(task)
+		}
+		if IsPanic(failure) {
+			slog.Error("task handler panicked", slog.Int64("id", task.ID), slog.String("type", task.Type), slog.Any("error", failure))
+		}
+		return t.fail(task, failure)
+	}
+
+	return t.muxdb.Do(func(db *sql.DB) error {
+		if _, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, lease_until = NULL WHERE id = ? AND worker_id = ?`), Completed, time.Now().UnixNano(), task.ID, t.schedulerConfig.workerID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// unclaim gives a claimed task back without counting an attempt
+func (t *TasksMiddleware) unclaim(task Task[any]) error {
+	return t.muxdb.Do(func(db *sql.DB) error {
+		_, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, worker_id = NULL, lease_until = NULL WHERE id = ? AND worker_id = ?`), Enqueued, time.Now().UnixNano(), task.ID, t.schedulerConfig.workerID)
+		return err
+	})
+}
+
+func (t *TasksMiddleware) call(receiver ReceiverHandler, task Task[any]) error {
+	var result []reflect.Value
+	if !receiver.withContext {
+		result = receiver.consumer.Call([]reflect.Value{reflect.ValueOf(task.Payload)})
+	} else {
+		ctx := t.ctx
+		if receiver.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, receiver.timeout)
+			defer cancel()
+		}
+
+		info := TaskInfo{
+			ID:        task.ID,
+			Type:      task.Type,
+			Attempt:   task.Attempts + 1,
+			CreatedAt: task.CreatedAt,
+		}
+
+		result = receiver.consumer.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(info), reflect.ValueOf(task.Payload)})
+	}
+
+	if result[0].IsNil() {
+		return nil
+	}
+	if err, ok := result[0].Interface().(error); ok {
+		return err
+	}
+	return fmt.Errorf("consumer function must return an error")
+}
+
+// reserve a slot for a task of that type, false when all workers or all the slots of the type are busy
+func (t *TasksMiddleware) reserve(name string, concurrency int) bool {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	if t.running >= t.schedulerConfig.workers {
+		return false
+	}
+	if concurrency > 0 && t.inflight[name] >= concurrency {
+		return false
+	}
+	t.running++
+	t.inflight[name]++
+	return true
+}
+
+func (t *TasksMiddleware) release(name string) {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	t.running--
+	t.inflight[name]--
+}
+
+// fail either schedules the task again according to the retry policy of its handler or archives it
+func (t *TasksMiddleware) fail(task Task[any], failure error) error {
+	attempts := task.Attempts + 1
+	receiver, _ := t.receiver(task.Type)
+	policy := receiver.retry
+	now := time.Now()
+
+	return t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if policy.Retryable(failure, attempts) {
+			runAt := now.Add(policy.Backoff(attempts))
+			_, err = tx.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, error = ?, attempts = ?, run_at = ?, lease_until = NULL WHERE id = ? AND worker_id = ?`), Retry, now.UnixNano(), failure.Error(), attempts, runAt.UnixNano(), task.ID, t.schedulerConfig.workerID)
+		} else {
+			_, err = tx.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, error = ?, attempts = ?, lease_until = NULL WHERE id = ? AND worker_id = ?`), Archived, now.UnixNano(), failure.Error(), attempts, task.ID, t.schedulerConfig.workerID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := t.recordFailure(tx, task.ID, attempts, failure.Error(), now); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
 }
 
 // TODO: make dependency injection for the database
 func (t *TasksMiddleware) GetTasksByState(state State) ([]Task[any], error) {
+	return t.queryTasks(`SELECT `+taskColumns+` FROM jobs WHERE status = ? ORDER BY priority DESC, created_at, id LIMIT ?`, state, t.schedulerConfig.limit)
+}
+
+// Tasks enqueued or waiting for a retry whose time has come, only for the types having a receiver, grouped by queue.
+// The payloads newer than their receiver are left to the instances running the next version, the ones that
+// can't be decoded are archived with their error so they don't come back at every beat.
+func (t *TasksMiddleware) getDueTasks() (map[string][]Task[any], error) {
+	handled, versions := t.handledVersions()
+
+	due := map[string][]Task[any]{}
+	if len(versions) == 0 {
+		return due, nil
+	}
+
+	where := `status IN (?, ?) AND (run_at IS NULL OR run_at <= ?) AND (` + handled + `)`
+	args := append([]any{Enqueued, Retry, time.Now().UnixNano()}, versions...)
+
+	queues := []string{}
+	if err := t.muxdb.Do(func(db *sql.DB) error {
+		rows, err := db.Query(t.muxdb.Rebind(`SELECT DISTINCT queue FROM jobs WHERE `+where), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var queue string
+			if err := rows.Scan(&queue); err != nil {
+				return err
+			}
+			queues = append(queues, queue)
+		}
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+
+	// each queue gets its own `limit` so a busy queue can't hide the others
+	for _, queue := range queues {
+		tasks, undecodable, err := t.queryDecodedTasks(`SELECT `+taskColumns+` FROM jobs WHERE `+where+` AND queue = ? ORDER BY priority DESC, created_at, id LIMIT ?`, append(append([]any{}, args...), queue, t.schedulerConfig.limit)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			cause, ok := undecodable[task.ID]
+			if !ok {
+				due[queue] = append(due[queue], task)
+				continue
+			}
+			slog.Error("task payload can't be decoded, archiving it", slog.Int64("id", task.ID), slog.String("type", task.Type), slog.Any("error", cause))
+			if err := t.archiveUndecodable(task, cause); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return due, nil
+}
+
+// archiveUndecodable archives a due task whose payload its receiver can't decode, it can be requeued once fixed
+func (t *TasksMiddleware) archiveUndecodable(task Task[any], cause error) error {
+	attempts := task.Attempts + 1
+	now := time.Now()
+
+	return t.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, error = ?, attempts = ? WHERE id = ? AND status = ?`), Archived, now.UnixNano(), cause.Error(), attempts, task.ID, task.State)
+		if err != nil {
+			return err
+		}
+		// claimed or archived by someone else in the meantime
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return err
+		}
+
+		if err := t.recordFailure(tx, task.ID, attempts, cause.Error(), now); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// queryTasks decodes the payloads with their receiver, the ones that can't be decoded are given as is
+func (t *TasksMiddleware) queryTasks(query string, args ...any) ([]Task[any], error) {
+	tasks, _, err := t.queryDecodedTasks(query, args...)
+	return tasks, err
+}
+
+// queryDecodedTasks is `queryTasks` also returning the decode errors by task ID
+func (t *TasksMiddleware) queryDecodedTasks(query string, args ...any) ([]Task[any], map[int64]error, error) {
 	tasks := []Task[any]{}
+	undecodable := map[int64]error{}
 	err := t.muxdb.Do(func(db *sql.DB) error {
 
 		var rows *sql.Rows
 		var err error
 
-		if rows, err = db.Query(`SELECT id, type, status, created_at, updated_at, payload, error FROM jobs WHERE status = ? LIMIT ?`, state, t.schedulerConfig.limit); err != nil {
+		if rows, err = db.Query(t.muxdb.Rebind(query), args...); err != nil {
 			return err
 		}
 		defer rows.Close()
@@ -222,8 +632,9 @@ func (t *TasksMiddleware) GetTasksByState(state State) ([]Task[any], error) {
 			var updatedAt sql.Null[int64]
 			var payload string
 			var errorData sql.Null[string]
+			var runAt sql.Null[int64]
 
-			if err := rows.Scan(&row.ID, &row.Type, &row.State, &createdAt, &updatedAt, &payload, &errorData); err != nil {
+			if err := rows.Scan(&row.ID, &row.Type, &row.State, &createdAt, &updatedAt, &payload, &errorData, &row.Attempts, &runAt, &row.Queue, &row.Priority, &row.PayloadVersion); err != nil {
 				return err
 			}
 
@@ -237,17 +648,24 @@ func (t *TasksMiddleware) GetTasksByState(state State) ([]Task[any], error) {
 				row.Error = &errorData.V
 			}
 
+			if runAt.Valid {
+				due := time.Unix(0, runAt.V)
+				row.RunAt = &due
+			}
+
 			// dynamically use the type of the receiver to translate back into the type of the payload
 			// so we can keep the generic working
-			paramInstancePtr := reflect.New(t.receivers[row.Type].consumerType).Interface()
-
-			//	this will avoid having a `map[string]interface{} cannot be converted to blablablabla` error
-			err = json.Unmarshal([]byte(payload), paramInstancePtr)
-			if err != nil {
-				return err
+			receiver, ok := t.receiver(row.Type)
+			if !ok {
+				// nothing to decode it into, the payload is given as is
+				row.Payload = json.RawMessage(payload)
+				tasks = append(tasks, row)
+				continue
+			}
+			if row.Payload, err = receiver.decode([]byte(payload), row.PayloadVersion); err != nil {
+				undecodable[row.ID] = err
+				row.Payload = json.RawMessage(payload)
 			}
-
-			row.Payload = reflect.ValueOf(paramInstancePtr).Elem().Interface()
 
 			tasks = append(tasks, row)
 		}
@@ -257,60 +675,200 @@ func (t *TasksMiddleware) GetTasksByState(state State) ([]Task[any], error) {
 		return nil
 	})
 
-	return tasks, err
+	return tasks, undecodable, err
 }
 
+// Beat claims the due tasks the workers have room for and hands them over, it never waits for their execution
 func (t *TasksMiddleware) Beat() error {
-	return t.muxdb.Do(func(db *sql.DB) error {
+	if t.work == nil {
+		return fmt.Errorf("tasks middleware is not initialized")
+	}
 
-		tasksEnqueued, err := t.GetTasksByState(Enqueued)
-		if err != nil {
-			return err
+	if err := t.reap(time.Now()); err != nil {
+		return err
+	}
+
+	if err := t.materialize(time.Now()); err != nil {
+		return err
+	}
+
+	if err := t.watchOrphans(); err != nil {
+		return err
+	}
+
+	due, err := t.getDueTasks()
+	if err != nil {
+		return err
+	}
+
+	for t.available() {
+		queue, ok := t.nextQueue(due)
+		if !ok {
+			break
 		}
+		task := due[queue][0]
+		due[queue] = due[queue][1:]
 
-		if len(tasksEnqueued) > 0 {
-			if err := t.propagate(tasksEnqueued); err != nil {
-				log.Fatal(err)
+		receiver, ok := t.receiver(task.Type)
+		if !ok {
+			continue
+		}
+		if !t.reserve(task.Type, receiver.concurrency) {
+			continue
+		}
+
+		claimed, err := t.claim(task)
+		if err != nil || !claimed {
+			t.release(task.Type)
+			if err != nil {
+				return err
 			}
+			continue
 		}
 
+		task.State = Pending
+		t.work <- task
+	}
+
+	return nil
+}
+
+// claim moves the task to `Pending` only if nobody else did it in the meantime
+func (t *TasksMiddleware) claim(task Task[any]) (bool, error) {
+	var claimed bool
+	err := t.muxdb.Do(func(db *sql.DB) error {
+		now := time.Now()
+		result, err := db.Exec(t.muxdb.Rebind(`UPDATE jobs SET status = ?, updated_at = ?, worker_id = ?, lease_until = ? WHERE id = ? AND status = ?`), Pending, now.UnixNano(), t.schedulerConfig.workerID, now.Add(t.schedulerConfig.lease).UnixNano(), task.ID, task.State)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		claimed = affected == 1
 		return nil
 	})
+	return claimed, err
 }
 
-func (t *TasksMiddleware) Send(data any) error {
-
-	var err error
-	var valueOfWork interface{} = data
+// Send stores the task to be run as soon as possible
+func (t *TasksMiddleware) Send(data any, opts ...sendOptions) error {
+	_, err := t.Enqueue(data, opts...)
+	return err
+}
 
-	if reflect.TypeOf(data).Kind() == reflect.Ptr {
-		valueOfWork = reflect.ValueOf(data).Elem().Interface()
-	}
+// SendAt stores the task to be run once `at` is reached
+func (t *TasksMiddleware) SendAt(data any, at time.Time, opts ...sendOptions) error {
+	_, err := t.Enqueue(data, append(opts, WithRunAt(at))...)
+	return err
+}
 
-	// extract the name of the type of the data
-	nameType := reflect.TypeOf(valueOfWork).Name()
+// SendAfter stores the task to be run once `delay` has elapsed
+func (t *TasksMiddleware) SendAfter(data any, delay time.Duration, opts ...sendOptions) error {
+	return t.SendAt(data, time.Now().Add(delay), opts...)
+}
 
-	err = t.muxdb.Do(func(db *sql.DB) error {
+// Enqueue stores the task and returns its ID.
+// With a unique key, a duplicate is resolved by the `ConflictPolicy` and the returned ID depends on it.
+func (t *TasksMiddleware) Enqueue(data any, opts ...sendOptions) (int64, error) {
+	var id int64
+	err := t.muxdb.Do(func(db *sql.DB) error {
 		tx, err := db.BeginTx(context.Background(), nil)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		var dataJson []byte
-		if dataJson, err = json.Marshal(valueOfWork); err != nil {
+		if id, err = t.EnqueueTx(tx, data, opts...); err != nil {
 			tx.Rollback()
 			return err
 		}
-		if _, err = tx.Exec(`
-			INSERT INTO jobs (status, type, payload, created_at) 
-			VALUES (?, ?, ?, ?);
-		`, Enqueued, nameType, string(dataJson), time.Now().UnixNano()); err != nil {
-			tx.Rollback()
-			return err
-		}
-		// return nil
 		return tx.Commit()
 	})
 
+	return id, err
+}
+
+// SendTx stores the task within the caller's transaction, it only exists if the transaction commits
+func (t *TasksMiddleware) SendTx(tx *sql.Tx, data any, opts ...sendOptions) error {
+	_, err := t.EnqueueTx(tx, data, opts...)
 	return err
 }
+
+// EnqueueTx is `Enqueue` within the caller's transaction
+func (t *TasksMiddleware) EnqueueTx(tx *sql.Tx, data any, opts ...sendOptions) (int64, error) {
+	var valueOfWork interface{} = data
+
+	if reflect.TypeOf(data).Kind() == reflect.Ptr {
+		valueOfWork = reflect.ValueOf(data).Elem().Interface()
+	}
+
+	// the name of the handler of that type, or the name of the type itself
+	nameType, version, err := t.taskName(valueOfWork)
+	if err != nil {
+		return 0, err
+	}
+
+	config := newSendConfig(opts...)
+	config.version = version
+
+	return t.insertTask(tx, nameType, valueOfWork, config)
+}
+
+func (t *TasksMiddleware) insertTask(tx *sql.Tx, nameType string, payload any, config sendConfig) (int64, error) {
+	dataJson, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var runAt sql.Null[int64]
+	if config.runAt != nil {
+		runAt = sql.Null[int64]{V: config.runAt.UnixNano(), Valid: true}
+	}
+
+	key, until := config.unique(nameType, dataJson, now)
+	if !key.Valid {
+		var id int64
+		err = tx.QueryRow(t.muxdb.Rebind(`
+			INSERT INTO jobs (status, type, payload, created_at, run_at, queue, priority, payload_version) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			RETURNING id;
+		`), Enqueued, nameType, string(dataJson), now.UnixNano(), runAt, config.queue, config.priority, config.version).Scan(&id)
+		return id, err
+	}
+
+	// the key of a task out of its window is free again
+	if _, err := tx.Exec(t.muxdb.Rebind(`
+		UPDATE jobs SET unique_key = NULL
+		WHERE unique_key = ? AND ((unique_until IS NOT NULL AND unique_until <= ?) OR (unique_until IS NULL AND status IN (?, ?)))
+	`), key, now.UnixNano(), Completed, Archived); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRow(t.muxdb.Rebind(`
+		INSERT INTO jobs (status, type, payload, created_at, run_at, queue, priority, payload_version, unique_key, unique_until) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (unique_key) DO NOTHING
+		RETURNING id;
+	`), Enqueued, nameType, string(dataJson), now.UnixNano(), runAt, config.queue, config.priority, config.version, key, until).Scan(&id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return id, err
+	}
+
+	if err := tx.QueryRow(t.muxdb.Rebind(`SELECT id FROM jobs WHERE unique_key = ?`), key).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	switch config.conflict {
+	case ConflictIgnore:
+		return 0, nil
+	case ConflictReplace:
+		// a task already running or done is left alone
+		if _, err := tx.Exec(t.muxdb.Rebind(`UPDATE jobs SET payload = ?, payload_version = ?, run_at = ?, queue = ?, priority = ?, updated_at = ? WHERE id = ? AND status IN (?, ?)`), string(dataJson), config.version, runAt, config.queue, config.priority, now.UnixNano(), id, Enqueued, Retry); err != nil {
+			return 0, err
+		}
+		return id, nil
+	default:
+		return id, nil
+	}
+}
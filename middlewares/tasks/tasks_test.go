@@ -1,11 +1,17 @@
 package tasks
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/migrations"
 	"github.com/k0kubun/pp/v3"
 	"github.com/mattn/go-sqlite3"
 )
@@ -57,13 +63,13 @@ func TestSimpleTask(t *testing.T) {
 						switch op {
 
 						case sqlite3.SQLITE_INSERT:
-							middleware.OnInsert(conn, db, table, rowid)
+							middleware.OnInsert(data.ChangeEvent{Op: data.Insert, Schema: db, Table: table, RowID: rowid})
 
 						case sqlite3.SQLITE_UPDATE:
-							middleware.OnUpdate(conn, db, table, rowid)
+							middleware.OnUpdate(data.ChangeEvent{Op: data.Update, Schema: db, Table: table, RowID: rowid})
 
 						case sqlite3.SQLITE_DELETE:
-							middleware.OnDelete(conn, db, table, rowid)
+							middleware.OnDelete(data.ChangeEvent{Op: data.Delete, Schema: db, Table: table, RowID: rowid})
 
 						}
 					},
@@ -77,7 +83,13 @@ func TestSimpleTask(t *testing.T) {
 		t.Error(err)
 	}
 
-	if err := middleware.OnInit(data.NewMuxDb(db)); err != nil {
+	muxdb := data.NewMuxDb(db)
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Error(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
 		t.Error(err)
 	}
 
@@ -125,3 +137,1324 @@ func TestSimpleTask(t *testing.T) {
 	}
 	pp.Println(data)
 }
+
+type FlakyMsg struct {
+	Fail int
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := ExponentialBackoff(3, time.Millisecond*100, time.Millisecond*300)
+	policy.Jitter = 0
+
+	if backoff := policy.Backoff(1); backoff != time.Millisecond*100 {
+		t.Errorf("expected 100ms, got %v", backoff)
+	}
+	if backoff := policy.Backoff(2); backoff != time.Millisecond*200 {
+		t.Errorf("expected 200ms, got %v", backoff)
+	}
+	if backoff := policy.Backoff(3); backoff != time.Millisecond*300 {
+		t.Errorf("expected the backoff to be capped at 300ms, got %v", backoff)
+	}
+
+	failure := fmt.Errorf("failed")
+	if !policy.Retryable(failure, 2) {
+		t.Error("expected the second attempt to be retryable")
+	}
+	if policy.Retryable(failure, 3) {
+		t.Error("expected the last attempt not to be retryable")
+	}
+	if policy.Retryable(fmt.Errorf("wrapped: %w", Permanent(failure)), 1) {
+		t.Error("expected a permanent error not to be retryable")
+	}
+	if NoRetry().Retryable(failure, 1) {
+		t.Error("expected no retry by default")
+	}
+}
+
+func TestTaskRetries(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:retries?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	if err := middleware.Register(NewHandler[FlakyMsg](
+		func() func(data FlakyMsg) error {
+			return func(data FlakyMsg) error {
+				if int(calls.Add(1)) <= data.Fail {
+					return fmt.Errorf("attempt %d failed", calls.Load())
+				}
+				return nil
+			}
+		},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond * 50}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	if err := middleware.Send(FlakyMsg{Fail: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		completed, err := middleware.GetTasksByState(Completed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(completed) == 1 {
+			if completed[0].Attempts != 2 {
+				t.Errorf("expected 2 failed attempts, got %d", completed[0].Attempts)
+			}
+			if calls.Load() != 3 {
+				t.Errorf("expected 3 calls, got %d", calls.Load())
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("task never completed")
+}
+
+type SlowMsg struct {
+	Index int
+}
+
+func TestWorkerPool(t *testing.T) {
+	cases := []struct {
+		name        string
+		workers     int
+		concurrency int
+		expected    int32
+	}{
+		{name: "workers", workers: 4, expected: 4},
+		{name: "concurrency", workers: 4, concurrency: 2, expected: 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", "file:workers_"+c.name+"?mode=memory&cache=shared&_busy_timeout=5000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			muxdb := data.NewMuxDb(db)
+			middleware := New(WithTicker(time.Millisecond*20), WithWorkers(c.workers))
+
+			if err := migrations.Apply(muxdb, middleware); err != nil {
+				t.Fatal(err)
+			}
+
+			var current, peak atomic.Int32
+			if err := middleware.Register(NewHandler[SlowMsg](
+				func() func(data SlowMsg) error {
+					return func(data SlowMsg) error {
+						running := current.Add(1)
+						for {
+							observed := peak.Load()
+							if running <= observed || peak.CompareAndSwap(observed, running) {
+								break
+							}
+						}
+						time.Sleep(time.Millisecond * 200)
+						current.Add(-1)
+						return nil
+					}
+				},
+				WithConcurrency(c.concurrency),
+			)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := middleware.OnInit(muxdb); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range 8 {
+				if err := middleware.Send(SlowMsg{Index: i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(time.Second * 5)
+			for time.Now().Before(deadline) {
+				completed, err := middleware.GetTasksByState(Completed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(completed) == 8 {
+					break
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+
+			if err := middleware.OnClose(); err != nil {
+				t.Fatal(err)
+			}
+
+			if peak.Load() != c.expected {
+				t.Errorf("expected %d tasks running at once, got %d", c.expected, peak.Load())
+			}
+		})
+	}
+}
+
+type ReminderMsg struct {
+	Msg string
+}
+
+func TestDelayedTask(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:delayed?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan time.Time, 2)
+	if err := middleware.Register(NewHandler[ReminderMsg](
+		func() func(data ReminderMsg) error {
+			return func(data ReminderMsg) error {
+				received <- time.Now()
+				return nil
+			}
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	sent := time.Now()
+	if err := middleware.SendAfter(ReminderMsg{Msg: "later"}, time.Millisecond*300); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueued, err := middleware.GetTasksByState(Enqueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enqueued) != 1 || enqueued[0].RunAt == nil {
+		t.Fatalf("expected one delayed task, got %v", enqueued)
+	}
+
+	select {
+	case at := <-received:
+		if at.Sub(sent) < time.Millisecond*300 {
+			t.Errorf("task ran after %v, before its time", at.Sub(sent))
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("delayed task never ran")
+	}
+}
+
+type DigestMsg struct {
+	Tick int64
+}
+
+func TestCronMissedTicks(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   MissedTicks
+		expected int
+	}{
+		{name: "catch_up", policy: CatchUp, expected: 5},
+		{name: "skip_missed", policy: SkipMissed, expected: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", "file:cron_"+c.name+"?mode=memory&cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			muxdb := data.NewMuxDb(db)
+
+			newMiddleware := func() *TasksMiddleware {
+				middleware := New()
+				middleware.muxdb = muxdb
+				handler, err := NewCron[DigestMsg](
+					"@every 1m",
+					func(tick time.Time) DigestMsg {
+						return DigestMsg{Tick: tick.Unix()}
+					},
+					func() func(data DigestMsg) error {
+						return func(data DigestMsg) error {
+							return nil
+						}
+					},
+					WithMissedTicks(c.policy),
+					WithTimezone(time.UTC),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := middleware.Register(handler); err != nil {
+					t.Fatal(err)
+				}
+				return middleware
+			}
+
+			middleware := newMiddleware()
+			if err := migrations.Apply(muxdb, middleware); err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			if err := middleware.materialize(start); err != nil {
+				t.Fatal(err)
+			}
+
+			// five minutes of downtime, then two instances restart
+			later := start.Add(time.Minute * 5)
+			if err := middleware.materialize(later); err != nil {
+				t.Fatal(err)
+			}
+			if err := newMiddleware().materialize(later); err != nil {
+				t.Fatal(err)
+			}
+
+			enqueued, err := middleware.GetTasksByState(Enqueued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(enqueued) != c.expected {
+				t.Fatalf("expected %d tasks, got %d", c.expected, len(enqueued))
+			}
+			if last := enqueued[len(enqueued)-1].Payload.(DigestMsg); last.Tick != later.Unix() {
+				t.Errorf("expected the last tick at %v, got %v", later.Unix(), last.Tick)
+			}
+		})
+	}
+
+	if _, err := NewCron[DigestMsg]("not a cron", nil, nil); err == nil {
+		t.Error("expected an invalid expression to fail")
+	}
+}
+
+type StrandedMsg struct {
+	Index int
+}
+
+type AbandonedMsg struct {
+	Index int
+}
+
+func TestStrandedTasksRecovery(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:stranded?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond*20), WithWorkerID("worker-1"), WithLease(time.Second))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var handled atomic.Int32
+	if err := middleware.Register(NewHandler[StrandedMsg](
+		func() func(data StrandedMsg) error {
+			return func(data StrandedMsg) error {
+				handled.Add(1)
+				return nil
+			}
+		},
+		WithRetryPolicy(ExponentialBackoff(3, time.Millisecond*10, time.Millisecond*20)),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	// `NoRetry`, a stranded attempt is its only one
+	var abandoned atomic.Int32
+	if err := middleware.Register(NewHandler[AbandonedMsg](
+		func() func(data AbandonedMsg) error {
+			return func(data AbandonedMsg) error {
+				abandoned.Add(1)
+				return nil
+			}
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	stranded := []struct {
+		state      State
+		workerID   string
+		leaseUntil time.Time
+	}{
+		// a crashed worker that claimed a task but never started it
+		{state: Pending, workerID: "worker-2", leaseUntil: now.Add(-time.Minute)},
+		// a crashed worker in the middle of a handler
+		{state: Active, workerID: "worker-2", leaseUntil: now.Add(-time.Minute)},
+		// this worker before its restart, the lease didn't expire yet
+		{state: Active, workerID: "worker-1", leaseUntil: now.Add(time.Hour)},
+	}
+	for i, s := range stranded {
+		if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at, worker_id, lease_until) VALUES (?, ?, ?, ?, ?, ?)`, s.state, "StrandedMsg", fmt.Sprintf(`{"Index": %d}`, i), now.UnixNano(), s.workerID, s.leaseUntil.UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at, worker_id, lease_until) VALUES (?, ?, ?, ?, ?, ?)`, Active, "AbandonedMsg", `{"Index": 3}`, now.UnixNano(), "worker-2", now.Add(-time.Minute).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) && handled.Load() < 3 {
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if err := middleware.OnClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := middleware.GetTasksByState(Completed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 3 {
+		t.Fatalf("expected the 3 stranded tasks to complete, got %d", len(completed))
+	}
+	for _, task := range completed {
+		index := task.Payload.(StrandedMsg).Index
+		if expected := map[int]int{0: 0, 1: 1, 2: 1}[index]; task.Attempts != expected {
+			t.Errorf("expected %d attempts for the task %d, got %d", expected, index, task.Attempts)
+		}
+	}
+
+	archived, err := middleware.GetTasksByState(Archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 || archived[0].Type != "AbandonedMsg" || archived[0].Attempts != 1 || abandoned.Load() != 0 {
+		t.Fatalf("expected the stranded task without retry to be archived, got %v after %d calls", archived, abandoned.Load())
+	}
+}
+
+func TestExecuteLostClaim(t *testing.T) {
+	db := openMemory(t, "lost_claim")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithWorkerID("worker-1"))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+	middleware.muxdb = muxdb
+
+	var handled atomic.Int32
+	if err := middleware.Register(NewHandler[StrandedMsg](
+		func() func(data StrandedMsg) error {
+			return func(data StrandedMsg) error {
+				handled.Add(1)
+				return nil
+			}
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	// reaped then claimed by another worker before this one got to run it
+	var id int64
+	if err := db.QueryRow(`INSERT INTO jobs (status, type, payload, created_at, worker_id) VALUES (?, ?, ?, ?, ?) RETURNING id`, Pending, "StrandedMsg", `{"Index": 0}`, time.Now().UnixNano(), "worker-2").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.execute(Task[any]{ID: id, Type: "StrandedMsg", State: Pending, Payload: StrandedMsg{}}); err != nil {
+		t.Fatal(err)
+	}
+	if handled.Load() != 0 {
+		t.Fatal("expected the handler not to run for a task claimed by another worker")
+	}
+
+	var state State
+	if err := db.QueryRow(`SELECT status FROM jobs WHERE id = ?`, id).Scan(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state != Pending {
+		t.Errorf("expected the task to stay with the other worker, got %v", state)
+	}
+}
+
+func TestStartupRecoveryWithoutWorkerID(t *testing.T) {
+	db := openMemory(t, "stranded_startup")
+
+	muxdb := data.NewMuxDb(db)
+	// no beat happens during the test, only the startup pass can recover the tasks
+	middleware := New(WithTicker(time.Hour))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	stranded := []struct {
+		workerID   string
+		leaseUntil time.Time
+	}{
+		// the previous process of this host, its random suffix can't match the new one
+		{workerID: "host-123-0a1b2c3d", leaseUntil: now.Add(-time.Minute)},
+		// another worker still holding its task
+		{workerID: "host-456-4e5f6a7b", leaseUntil: now.Add(time.Hour)},
+	}
+	for i, s := range stranded {
+		if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at, worker_id, lease_until) VALUES (?, ?, ?, ?, ?, ?)`, Active, "StrandedMsg", fmt.Sprintf(`{"Index": %d}`, i), now.UnixNano(), s.workerID, s.leaseUntil.UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	for state, expected := range map[State]int{Retry: 1, Active: 1} {
+		tasks, err := middleware.GetTasksByState(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) != expected {
+			t.Errorf("expected %d %v tasks right after the start, got %d", expected, state, len(tasks))
+		}
+	}
+}
+
+type TimedMsg struct {
+	Wait time.Duration
+}
+
+func TestContextHandler(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:context?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := make(chan TaskInfo, 1)
+	if err := middleware.Register(NewContextHandler[TimedMsg](
+		func() func(ctx context.Context, info TaskInfo, data TimedMsg) error {
+			return func(ctx context.Context, info TaskInfo, data TimedMsg) error {
+				infos <- info
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(data.Wait):
+					return nil
+				}
+			}
+		},
+		WithTimeout(time.Millisecond*50),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing could interrupt a handler without a context
+	if err := middleware.Register(NewHandler[PingMsg](func() func(data PingMsg) error {
+		return func(data PingMsg) error {
+			return nil
+		}
+	}, WithTimeout(time.Millisecond*50))); err == nil {
+		t.Error("expected a timeout without context to be refused")
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	if err := middleware.Send(TimedMsg{Wait: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case info := <-infos:
+		if info.ID == 0 || info.Type != "TimedMsg" || info.Attempt != 1 || info.CreatedAt.IsZero() {
+			t.Errorf("unexpected task info %v", info)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler never called")
+	}
+
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		archived, err := middleware.GetTasksByState(Archived)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archived) == 1 {
+			if archived[0].Error == nil || *archived[0].Error != context.DeadlineExceeded.Error() {
+				t.Errorf("expected the deadline to be exceeded, got %v", archived[0].Error)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("task never timed out")
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	cases := []struct {
+		name     string
+		wait     time.Duration
+		shutdown time.Duration
+		expected State
+	}{
+		{name: "finished", wait: time.Millisecond * 100, shutdown: time.Second, expected: Completed},
+		{name: "cancelled", wait: time.Hour, shutdown: time.Millisecond * 100, expected: Enqueued},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", "file:shutdown_"+c.name+"?mode=memory&cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			muxdb := data.NewMuxDb(db)
+			middleware := New(WithTicker(time.Millisecond*20), WithShutdownTimeout(c.shutdown))
+
+			if err := migrations.Apply(muxdb, middleware); err != nil {
+				t.Fatal(err)
+			}
+
+			started := make(chan struct{}, 1)
+			if err := middleware.Register(NewContextHandler[TimedMsg](
+				func() func(ctx context.Context, info TaskInfo, data TimedMsg) error {
+					return func(ctx context.Context, info TaskInfo, data TimedMsg) error {
+						started <- struct{}{}
+						select {
+						case <-ctx.Done():
+							return fmt.Errorf("interrupted: %w", ctx.Err())
+						case <-time.After(data.Wait):
+							return nil
+						}
+					}
+				},
+			)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := middleware.OnInit(muxdb); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := middleware.Send(TimedMsg{Wait: c.wait}); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-started:
+			case <-time.After(time.Second * 3):
+				t.Fatal("handler never called")
+			}
+
+			if err := middleware.OnClose(); err != nil {
+				t.Fatal(err)
+			}
+
+			tasks, err := middleware.GetTasksByState(c.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) != 1 || tasks[0].Attempts != 0 {
+				t.Errorf("expected the task %v without failed attempt, got %v", c.expected, tasks)
+			}
+		})
+	}
+}
+
+type PanickyMsg struct {
+	Panics int
+}
+
+func TestHandlerPanic(t *testing.T) {
+	db := openMemory(t, "panic")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	if err := middleware.Register(NewHandler[PanickyMsg](
+		func() func(data PanickyMsg) error {
+			return func(data PanickyMsg) error {
+				if int(calls.Add(1)) <= data.Panics {
+					panic("boom")
+				}
+				return nil
+			}
+		},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	// retried once after the panic then archived after the second one
+	if err := middleware.Send(PanickyMsg{Panics: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		archived, err := middleware.GetTasksByState(Archived)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archived) == 1 {
+			if archived[0].Attempts != 2 {
+				t.Errorf("expected 2 attempts, got %d", archived[0].Attempts)
+			}
+			if archived[0].Error == nil || !strings.HasPrefix(*archived[0].Error, "panic: boom") || !strings.Contains(*archived[0].Error, "goroutine") {
+				t.Errorf("expected the panic and its stack, got %v", archived[0].Error)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	// the workers survived
+	if err := middleware.Send(PanickyMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	for time.Now().Before(deadline) {
+		completed, err := middleware.GetTasksByState(Completed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(completed) == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("tasks are not processed anymore after a panic")
+}
+
+type FailingMsg struct {
+	Reason string
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	db := openMemory(t, "dlq")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	var healthy atomic.Bool
+	if err := middleware.Register(NewHandler[FailingMsg](
+		func() func(data FailingMsg) error {
+			return func(data FailingMsg) error {
+				if healthy.Load() {
+					return nil
+				}
+				return fmt.Errorf("%s", data.Reason)
+			}
+		},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	for _, reason := range []string{"disk full", "timeout", "disk_full 100%"} {
+		if err := middleware.Send(FailingMsg{Reason: reason}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor := func(state State, count int) []Task[any] {
+		deadline := time.Now().Add(time.Second * 3)
+		for time.Now().Before(deadline) {
+			tasks, err := middleware.GetTasksByState(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) == count {
+				return tasks
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		t.Fatalf("expected %d tasks %v", count, state)
+		return nil
+	}
+	waitFor(Archived, 3)
+
+	disk, err := middleware.GetArchivedTasks(ArchivedFilter{Type: "FailingMsg", ErrorContains: "disk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disk) != 2 {
+		t.Fatalf("expected 2 disk failures, got %d", len(disk))
+	}
+
+	// the wildcards of LIKE are taken literally
+	literal, err := middleware.GetArchivedTasks(ArchivedFilter{ErrorContains: "_full 100%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(literal) != 1 || literal[0].Payload.(FailingMsg).Reason != "disk_full 100%" {
+		t.Errorf("expected only the literal match, got %v", literal)
+	}
+
+	page, err := middleware.GetArchivedTasks(ArchivedFilter{Offset: 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 {
+		t.Errorf("expected 1 task on the second page, got %d", len(page))
+	}
+
+	count, err := middleware.CountArchivedTasks(ArchivedFilter{From: time.Now().Add(-time.Minute), To: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 archived tasks in the range, got %d", count)
+	}
+
+	failures, err := middleware.GetTaskFailures(disk[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 || failures[0].Attempt != 1 || failures[1].Attempt != 2 || failures[1].Error != disk[0].Payload.(FailingMsg).Reason {
+		t.Errorf("expected the history of both attempts, got %v", failures)
+	}
+
+	healthy.Store(true)
+	requeued, err := middleware.Requeue(disk[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 {
+		t.Fatalf("expected 1 requeued task, got %d", requeued)
+	}
+	if completed := waitFor(Completed, 1); completed[0].ID != disk[0].ID || completed[0].Attempts != 0 {
+		t.Errorf("expected the requeued task to complete on its first attempt, got %v", completed[0])
+	}
+
+	purged, err := middleware.PurgeArchived(ArchivedFilter{Type: "FailingMsg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 purged tasks, got %d", purged)
+	}
+	if failures, err := middleware.GetTaskFailures(disk[1].ID); err != nil || len(failures) != 0 {
+		t.Errorf("expected the history to be purged too, got %v %v", failures, err)
+	}
+}
+
+type NotificationMsg struct {
+	Label string
+}
+
+func TestQueuesAndPriorities(t *testing.T) {
+	db := openMemory(t, "queues")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New()
+	middleware.muxdb = muxdb
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.Register(NewHandler[NotificationMsg](
+		func() func(data NotificationMsg) error {
+			return func(data NotificationMsg) error {
+				return nil
+			}
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	sends := []struct {
+		label string
+		opts  []sendOptions
+	}{
+		{label: "low"},
+		{label: "high", opts: []sendOptions{WithPriority(10)}},
+		{label: "medium", opts: []sendOptions{WithPriority(5)}},
+		{label: "second high", opts: []sendOptions{WithPriority(10)}},
+		{label: "email", opts: []sendOptions{WithQueue("emails"), WithPriority(100)}},
+	}
+	for _, send := range sends {
+		if err := middleware.Send(NotificationMsg{Label: send.label}, send.opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, err := middleware.getDueTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := []string{}
+	for _, task := range due[DefaultQueue] {
+		labels = append(labels, task.Payload.(NotificationMsg).Label)
+	}
+	if fmt.Sprint(labels) != fmt.Sprint([]string{"high", "second high", "medium", "low"}) {
+		t.Errorf("expected the default queue by priority then creation, got %v", labels)
+	}
+	if len(due["emails"]) != 1 || due["emails"][0].Queue != "emails" || due["emails"][0].Priority != 100 {
+		t.Errorf("expected the email in its own queue, got %v", due["emails"])
+	}
+}
+
+func TestQueueWeights(t *testing.T) {
+	middleware := New(WithQueueWeights(map[string]int{"emails": 3}))
+
+	due := map[string][]Task[any]{
+		"emails":  make([]Task[any], 6),
+		"reports": make([]Task[any], 6),
+	}
+
+	picks := []string{}
+	for range 8 {
+		queue, ok := middleware.nextQueue(due)
+		if !ok {
+			t.Fatal("expected a queue")
+		}
+		due[queue] = due[queue][1:]
+		picks = append(picks, queue)
+	}
+
+	expected := []string{"emails", "emails", "reports", "emails", "emails", "emails", "reports", "emails"}
+	if fmt.Sprint(picks) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, picks)
+	}
+
+	// only the reports are left, they get every pick
+	due["emails"] = nil
+	if queue, _ := middleware.nextQueue(due); queue != "reports" {
+		t.Errorf("expected the reports, got %v", queue)
+	}
+}
+
+type InvoiceMsg struct {
+	Number int
+}
+
+func TestUniqueEnqueue(t *testing.T) {
+	db := openMemory(t, "unique")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New()
+	middleware.muxdb = muxdb
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue := func(data any, opts ...sendOptions) int64 {
+		id, err := middleware.Enqueue(data, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	first := enqueue(InvoiceMsg{Number: 1}, WithUniqueKey("invoice-1"))
+	if again := enqueue(InvoiceMsg{Number: 1}, WithUniqueKey("invoice-1")); again != first {
+		t.Errorf("expected the existing task %d, got %d", first, again)
+	}
+	if ignored := enqueue(InvoiceMsg{Number: 1}, WithUniqueKey("invoice-1"), WithOnConflict(ConflictIgnore)); ignored != 0 {
+		t.Errorf("expected nothing enqueued, got %d", ignored)
+	}
+	if replaced := enqueue(InvoiceMsg{Number: 42}, WithUniqueKey("invoice-1"), WithOnConflict(ConflictReplace), WithPriority(3)); replaced != first {
+		t.Errorf("expected the existing task to be replaced, got %d", replaced)
+	}
+	// keys are scoped by type
+	if other := enqueue(PingMsg{Msg: "hello"}, WithUniqueKey("invoice-1")); other == first {
+		t.Error("expected another type to have its own keys")
+	}
+
+	hashed := enqueue(InvoiceMsg{Number: 2}, WithUniquePayload())
+	if again := enqueue(InvoiceMsg{Number: 2}, WithUniquePayload()); again != hashed {
+		t.Errorf("expected the same payload to be deduplicated, got %d and %d", hashed, again)
+	}
+	if different := enqueue(InvoiceMsg{Number: 3}, WithUniquePayload()); different == hashed {
+		t.Error("expected another payload to be enqueued")
+	}
+
+	windowed := enqueue(InvoiceMsg{Number: 4}, WithUniqueKey("invoice-4"), WithUniqueFor(time.Millisecond*50))
+	time.Sleep(time.Millisecond * 60)
+	if later := enqueue(InvoiceMsg{Number: 4}, WithUniqueKey("invoice-4"), WithUniqueFor(time.Millisecond*50)); later == windowed {
+		t.Error("expected the key to be free after its window")
+	}
+
+	// without window the key is free once the task is done
+	if _, err := db.Exec(`UPDATE jobs SET status = ? WHERE id = ?`, Completed, first); err != nil {
+		t.Fatal(err)
+	}
+	if next := enqueue(InvoiceMsg{Number: 1}, WithUniqueKey("invoice-1")); next == first {
+		t.Error("expected the key of a completed task to be free")
+	}
+
+	var payload string
+	var priority int
+	if err := db.QueryRow(`SELECT payload, priority FROM jobs WHERE id = ?`, first).Scan(&payload, &priority); err != nil {
+		t.Fatal(err)
+	}
+	if payload != `{"Number":42}` || priority != 3 {
+		t.Errorf("expected the replaced payload and priority, got %v %v", payload, priority)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM jobs`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 {
+		t.Errorf("expected 7 tasks, got %d", count)
+	}
+}
+
+type OrderCreated struct {
+	AmountCents int
+}
+
+func TestNamedVersionedHandler(t *testing.T) {
+	db := openMemory(t, "naming")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New()
+	middleware.muxdb = muxdb
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := func() func(data OrderCreated) error {
+		return func(data OrderCreated) error {
+			return nil
+		}
+	}
+
+	if err := middleware.Register(NewHandler[OrderCreated](consumer, WithName("orders.created"), WithVersion(2))); err == nil {
+		t.Error("expected a missing upgrader to be refused")
+	}
+
+	// the version 1 stored the amount in euros
+	if err := middleware.Register(NewHandler[OrderCreated](
+		consumer,
+		WithName("orders.created"),
+		WithVersion(2),
+		WithUpgrader(1, func(payload json.RawMessage) (json.RawMessage, error) {
+			var v1 struct {
+				Amount int
+			}
+			if err := json.Unmarshal(payload, &v1); err != nil {
+				return nil, err
+			}
+			return json.Marshal(OrderCreated{AmountCents: v1.Amount * 100})
+		}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at, payload_version) VALUES (?, ?, ?, ?, ?)`, Enqueued, "orders.created", `{"Amount": 12}`, time.Now().UnixNano(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.Send(OrderCreated{AmountCents: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueued, err := middleware.GetTasksByState(Enqueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enqueued) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(enqueued))
+	}
+	if upgraded := enqueued[0].Payload.(OrderCreated); upgraded.AmountCents != 1200 || enqueued[0].PayloadVersion != 1 {
+		t.Errorf("expected the version 1 to be upgraded, got %v", enqueued[0])
+	}
+	if sent := enqueued[1]; sent.Type != "orders.created" || sent.PayloadVersion != 2 || sent.Payload.(OrderCreated).AmountCents != 500 {
+		t.Errorf("expected the explicit name and current version, got %v", sent)
+	}
+
+	anonymous := func() func(data struct{ Msg string }) error {
+		return func(data struct{ Msg string }) error {
+			return nil
+		}
+	}
+	if err := middleware.Register(NewHandler(anonymous)); err == nil {
+		t.Error("expected an anonymous type without name to be refused")
+	}
+	if err := middleware.Register(NewHandler(anonymous, WithName("anonymous"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.Send(struct{ Msg string }{Msg: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type ShipmentMsg struct {
+	Parcels int
+}
+
+func TestUndecodableTasks(t *testing.T) {
+	db := openMemory(t, "undecodable")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(time.Millisecond * 20))
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan int, 4)
+	if err := middleware.Register(NewHandler[ShipmentMsg](
+		func() func(data ShipmentMsg) error {
+			return func(data ShipmentMsg) error {
+				handled <- data.Parcels
+				return nil
+			}
+		},
+		WithName("shipments"),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored by an instance already running the next version, then a payload that doesn't match the type
+	for _, stored := range []struct {
+		payload string
+		version int
+	}{
+		{payload: `{"Parcels": 2, "Carrier": "post"}`, version: 2},
+		{payload: `{"Parcels": "many"}`, version: 1},
+	} {
+		if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at, payload_version) VALUES (?, ?, ?, ?, ?)`, Enqueued, "shipments", stored.payload, time.Now().UnixNano(), stored.version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	if err := middleware.Send(ShipmentMsg{Parcels: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case parcels := <-handled:
+		if parcels != 1 {
+			t.Errorf("expected the valid task to run, got %d parcels", parcels)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("the valid task never ran")
+	}
+
+	archived, err := middleware.GetArchivedTasks(ArchivedFilter{Type: "shipments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 || archived[0].Error == nil || !strings.Contains(*archived[0].Error, "cannot unmarshal") {
+		t.Errorf("expected the invalid payload to be archived with its error, got %v", archived)
+	}
+
+	// the newer version waits for its handler, readable as is
+	enqueued, err := middleware.GetTasksByState(Enqueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enqueued) != 1 || enqueued[0].PayloadVersion != 2 || string(enqueued[0].Payload.(json.RawMessage)) != `{"Parcels": 2, "Carrier": "post"}` {
+		t.Errorf("expected the newer task to stay enqueued with its raw payload, got %v", enqueued)
+	}
+}
+
+type LateMsg struct {
+	Msg string
+}
+
+func TestOrphanedTasks(t *testing.T) {
+	db := openMemory(t, "orphans")
+
+	muxdb := data.NewMuxDb(db)
+	middleware := New(WithTicker(10*time.Millisecond), WithOrphans(ParkOrphans))
+	middleware.muxdb = muxdb
+
+	if err := migrations.Apply(muxdb, middleware); err != nil {
+		t.Fatal(err)
+	}
+
+	// sent by a producer deployed before its consumer
+	if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at) VALUES (?, ?, ?, ?)`, Enqueued, "LateMsg", `{"Msg": "hello"}`, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := middleware.OnInit(muxdb); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.OnClose()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		parked, err := middleware.GetTasksByState(Parked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parked) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the orphaned task to be parked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if metric := middleware.MetricOrphanedTasks(); metric != 1 {
+		t.Errorf("expected 1 orphaned task, got %d", metric)
+	}
+	orphans, err := middleware.GetOrphanedTasks(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Type != "LateMsg" || string(orphans[0].Payload.(json.RawMessage)) != `{"Msg": "hello"}` {
+		t.Fatalf("expected the raw orphaned task, got %v", orphans)
+	}
+
+	received := make(chan string, 1)
+	if err := middleware.Register(NewHandler[LateMsg](func() func(data LateMsg) error {
+		return func(data LateMsg) error {
+			received <- data.Msg
+			return nil
+		}
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Errorf("expected hello, got %v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the parked task to run once its handler registered")
+	}
+
+	orphans, err = middleware.GetOrphanedTasks(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("expected no orphaned task left, got %v", orphans)
+	}
+}
+
+// An instance parking the tasks it has no handler for doesn't keep them from the instances having it
+func TestOrphansOfOtherInstances(t *testing.T) {
+	db := openMemory(t, "orphans_instances")
+
+	muxdb := data.NewMuxDb(db)
+	parking := New(WithTicker(10*time.Millisecond), WithWorkerID("parking"), WithOrphans(ParkOrphans))
+	handling := New(WithTicker(10*time.Millisecond), WithWorkerID("handling"))
+
+	if err := migrations.Apply(muxdb, parking); err != nil {
+		t.Fatal(err)
+	}
+
+	var received atomic.Int32
+	if err := handling.Register(NewHandler[LateMsg](func() func(data LateMsg) error {
+		return func(data LateMsg) error {
+			received.Add(1)
+			return nil
+		}
+	})); err != nil {
+		t.Fatal(err)
+	}
+	for _, middleware := range []*TasksMiddleware{parking, handling} {
+		if err := middleware.OnInit(muxdb); err != nil {
+			t.Fatal(err)
+		}
+		defer middleware.OnClose()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := handling.Send(LateMsg{Msg: fmt.Sprintf("hello %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// parked before the handling instance ever saw it
+	if _, err := db.Exec(`INSERT INTO jobs (status, type, payload, created_at) VALUES (?, ?, ?, ?)`, Parked, "LateMsg", `{"Msg": "parked"}`, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for received.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received.Load() != 6 {
+		t.Fatalf("expected the 6 tasks to be handled, got %d", received.Load())
+	}
+}
+
+// openMemory opens a named in-memory database on a single connection,
+// shared cache connections would fail with "table is locked" instead of waiting for each other
+func openMemory(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
@@ -0,0 +1,71 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// What `Enqueue` does when a task with the same unique key is still within its window
+type ConflictPolicy string
+
+var (
+	// The existing task is kept and its ID returned
+	ConflictReturnExisting ConflictPolicy = "return_existing"
+	// The existing task is kept and 0 returned
+	ConflictIgnore ConflictPolicy = "ignore"
+	// The payload, queue, priority and due time of the existing task are overwritten if it didn't start yet
+	ConflictReplace ConflictPolicy = "replace"
+)
+
+// Makes the task unique by `key` among the tasks of its type
+func WithUniqueKey(key string) sendOptions {
+	return func(c *sendConfig) {
+		c.uniqueKey = key
+	}
+}
+
+// Makes the task unique by its payload among the tasks of its type
+func WithUniquePayload() sendOptions {
+	return func(c *sendConfig) {
+		c.uniquePayload = true
+	}
+}
+
+// How long the key stays taken after the enqueue.
+// By default it is taken until the task is completed or archived.
+func WithUniqueFor(window time.Duration) sendOptions {
+	return func(c *sendConfig) {
+		c.uniqueFor = window
+	}
+}
+
+// Resolution of a duplicate, `ConflictReturnExisting` by default
+func WithOnConflict(policy ConflictPolicy) sendOptions {
+	return func(c *sendConfig) {
+		c.conflict = policy
+	}
+}
+
+// unique returns the stored key, scoped by type, and the end of its window
+func (c sendConfig) unique(nameType string, payload []byte, now time.Time) (sql.Null[string], sql.Null[int64]) {
+	var key sql.Null[string]
+	var until sql.Null[int64]
+
+	switch {
+	case c.uniqueKey != "":
+		key = sql.Null[string]{V: nameType + ":" + c.uniqueKey, Valid: true}
+	case c.uniquePayload:
+		hash := sha256.Sum256(payload)
+		key = sql.Null[string]{V: nameType + ":sha256:" + hex.EncodeToString(hash[:]), Valid: true}
+	default:
+		return key, until
+	}
+
+	if c.uniqueFor > 0 {
+		until = sql.Null[int64]{V: now.Add(c.uniqueFor).UnixNano(), Valid: true}
+	}
+
+	return key, until
+}
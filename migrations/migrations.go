@@ -0,0 +1,168 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+)
+
+/// Each middleware owns a namespace of versioned migrations, the user can add their own (default namespace `app`).
+/// Applied versions are recorded in the `schema_migrations` table so a migration only runs once per database.
+
+const DefaultNamespace = "app"
+
+// Step of a migration, runs within the transaction recording it
+type Step func(tx *sql.Tx, dialect data.Dialect) error
+
+// Run the statements as they are, whatever the dialect
+func SQL(statements ...string) Step {
+	return func(tx *sql.Tx, dialect data.Dialect) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Pick the step matching the dialect of the database
+func ForDialect(steps map[data.Dialect]Step) Step {
+	return func(tx *sql.Tx, dialect data.Dialect) error {
+		step, ok := steps[dialect]
+		if !ok {
+			return fmt.Errorf("no migration step for dialect %v", dialect)
+		}
+		return step(tx, dialect)
+	}
+}
+
+type Migration struct {
+	Namespace string
+	Version   int
+	Name      string
+	Up        Step
+	// Optional, the migration can't be rolled back without it
+	Down Step
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%v/%v %v", m.Namespace, m.Version, m.Name)
+}
+
+// Provider can be implemented by a middleware to ship the migrations of its tables
+type Provider interface {
+	Migrations() []Migration
+}
+
+// Preceder can be implemented by a provider whose migrations must run before the ones of other namespaces,
+// e.g. when it renames a table another namespace creates under the same name
+type Preceder interface {
+	Precedes() []string
+}
+
+// Registry keeps the migrations ordered by namespace (in registration order, unless a provider precedes another) then by version
+type Registry struct {
+	namespaces []string
+	migrations map[string][]Migration
+	// namespaces that must run before the key
+	preceded map[string][]string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		migrations: map[string][]Migration{},
+		preceded:   map[string][]string{},
+	}
+}
+
+// Provide registers the migrations of a provider, a `Preceder` also gets its namespace ordered before the ones it names
+func (r *Registry) Provide(provider Provider) error {
+	migrations := provider.Migrations()
+	if err := r.Register(migrations...); err != nil {
+		return err
+	}
+	preceder, ok := provider.(Preceder)
+	if !ok || len(migrations) == 0 {
+		return nil
+	}
+	namespace := migrations[0].Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	for _, other := range preceder.Precedes() {
+		r.Precede(namespace, other)
+	}
+	return nil
+}
+
+// Precede makes the migrations of `namespace` run before the ones of `other`, whatever their registration order
+func (r *Registry) Precede(namespace string, other string) {
+	for _, existing := range r.preceded[other] {
+		if existing == namespace {
+			return
+		}
+	}
+	r.preceded[other] = append(r.preceded[other], namespace)
+}
+
+func (r *Registry) Register(migrations ...Migration) error {
+	for _, migration := range migrations {
+		if migration.Namespace == "" {
+			migration.Namespace = DefaultNamespace
+		}
+		if migration.Version <= 0 {
+			return fmt.Errorf("migration %v must have a positive version", migration)
+		}
+		if migration.Up == nil {
+			return fmt.Errorf("migration %v must have an up step", migration)
+		}
+
+		existing, ok := r.migrations[migration.Namespace]
+		if !ok {
+			r.namespaces = append(r.namespaces, migration.Namespace)
+		}
+		for _, other := range existing {
+			if other.Version == migration.Version {
+				return fmt.Errorf("migration %v already registered as %v", migration, other)
+			}
+		}
+
+		existing = append(existing, migration)
+		sort.Slice(existing, func(i, j int) bool {
+			return existing[i].Version < existing[j].Version
+		})
+		r.migrations[migration.Namespace] = existing
+	}
+	return nil
+}
+
+// Namespaces in the order their migrations run: the registration order, except that a namespace comes after the ones preceding it.
+// A cycle between namespaces keeps the registration order.
+func (r *Registry) Namespaces() []string {
+	ordered := []string{}
+	visited := map[string]bool{}
+	var visit func(namespace string)
+	visit = func(namespace string) {
+		if visited[namespace] {
+			return
+		}
+		visited[namespace] = true
+		for _, before := range r.preceded[namespace] {
+			if _, ok := r.migrations[before]; ok {
+				visit(before)
+			}
+		}
+		ordered = append(ordered, namespace)
+	}
+	for _, namespace := range r.namespaces {
+		visit(namespace)
+	}
+	return ordered
+}
+
+func (r *Registry) Migrations(namespace string) []Migration {
+	return append([]Migration{}, r.migrations[namespace]...)
+}
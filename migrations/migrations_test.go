@@ -0,0 +1,166 @@
+package migrations
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openMemory(t *testing.T) *data.MuxDb {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would get its own memory database
+	db.SetMaxOpenConns(1)
+	return data.NewMuxDb(db)
+}
+
+func tableExists(t *testing.T, muxdb *data.MuxDb, table string) bool {
+	rows, err := muxdb.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(rows) == 1
+}
+
+func TestUpDown(t *testing.T) {
+	muxdb := openMemory(t)
+	defer muxdb.Close()
+
+	registry := NewRegistry()
+	if err := registry.Register(
+		Migration{
+			Version: 2,
+			Name:    "add email",
+			Up:      SQL(`ALTER TABLE users ADD COLUMN email TEXT NULL;`),
+			Down:    SQL(`ALTER TABLE users DROP COLUMN email;`),
+		},
+		Migration{
+			Version: 1,
+			Name:    "create users",
+			Up: ForDialect(map[data.Dialect]Step{
+				data.SQLite: SQL(`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL);`),
+			}),
+			Down: SQL(`DROP TABLE users;`),
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registry.Register(Migration{Version: 1, Name: "again", Up: SQL()}); err == nil {
+		t.Error("expected duplicated versions to be refused")
+	}
+
+	plan, err := NewMigrator(muxdb, registry, DryRun()).Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 || plan[0].Version != 1 || tableExists(t, muxdb, "users") {
+		t.Fatalf("dry run should only plan the migrations in order, got %v", plan)
+	}
+
+	migrator := NewMigrator(muxdb, registry)
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || !tableExists(t, muxdb, "users") {
+		t.Fatalf("expected both migrations applied, got %v", applied)
+	}
+
+	if applied, err = migrator.Up(); err != nil || len(applied) != 0 {
+		t.Fatalf("migrations should only run once, got %v %v", applied, err)
+	}
+
+	versions, err := migrator.Applied(DefaultNamespace)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected 2 recorded versions, got %v %v", versions, err)
+	}
+
+	rolledBack, err := migrator.Down(DefaultNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolledBack) != 2 || rolledBack[0].Version != 2 || tableExists(t, muxdb, "users") {
+		t.Fatalf("expected both migrations rolled back newest first, got %v", rolledBack)
+	}
+
+	if pending, err := migrator.Pending(); err != nil || len(pending) != 2 {
+		t.Fatalf("expected both migrations pending again, got %v %v", pending, err)
+	}
+}
+
+func TestFailedMigrationIsNotRecorded(t *testing.T) {
+	muxdb := openMemory(t)
+	defer muxdb.Close()
+
+	registry := NewRegistry()
+	if err := registry.Register(Migration{
+		Namespace: "broken",
+		Version:   1,
+		Name:      "half applied",
+		Up:        SQL(`CREATE TABLE half (id INTEGER);`, `NOT SQL;`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewMigrator(muxdb, registry).Up(); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if tableExists(t, muxdb, "half") {
+		t.Error("the failed migration should be rolled back")
+	}
+	if versions, err := NewMigrator(muxdb, registry).Applied("broken"); err != nil || len(versions) != 0 {
+		t.Errorf("the failed migration should not be recorded, got %v %v", versions, err)
+	}
+}
+
+type provider struct {
+	namespace string
+	precedes  []string
+}
+
+func (p provider) Migrations() []Migration {
+	return []Migration{{Namespace: p.namespace, Version: 1, Name: "create " + p.namespace, Up: SQL()}}
+}
+
+func (p provider) Precedes() []string {
+	return p.precedes
+}
+
+func TestPrecedence(t *testing.T) {
+	registry := NewRegistry()
+	for _, p := range []provider{
+		{namespace: "tasks"},
+		{namespace: "audit"},
+		{namespace: "jobs", precedes: []string{"tasks", "unknown"}},
+	} {
+		if err := registry.Provide(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.Register(Migration{Version: 1, Name: "create users", Up: SQL()}); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces := registry.Namespaces()
+	expected := []string{"jobs", "tasks", "audit", DefaultNamespace}
+	if len(namespaces) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, namespaces)
+	}
+	for i := range expected {
+		if namespaces[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, namespaces)
+		}
+	}
+
+	// a cycle keeps the registration order
+	registry.Precede("tasks", "jobs")
+	if namespaces := registry.Namespaces(); len(namespaces) != len(expected) {
+		t.Fatalf("expected every namespace once, got %v", namespaces)
+	}
+}
@@ -0,0 +1,207 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/davidroman0O/sql-toolbox/data"
+)
+
+var schemaMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	namespace TEXT NOT NULL,
+	version BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	applied_at BIGINT NOT NULL,
+	PRIMARY KEY (namespace, version)
+);
+`
+
+type migratorConfig struct {
+	dryRun bool
+}
+
+type MigratorOption func(*migratorConfig)
+
+// Only report the migrations that would run, nothing is applied
+func DryRun() MigratorOption {
+	return func(c *migratorConfig) {
+		c.dryRun = true
+	}
+}
+
+type Migrator struct {
+	muxdb    *data.MuxDb
+	registry *Registry
+	config   migratorConfig
+}
+
+func NewMigrator(muxdb *data.MuxDb, registry *Registry, opts ...MigratorOption) *Migrator {
+	migrator := &Migrator{
+		muxdb:    muxdb,
+		registry: registry,
+	}
+	for _, opt := range opts {
+		opt(&migrator.config)
+	}
+	return migrator
+}
+
+func (m *Migrator) DryRun() bool {
+	return m.config.dryRun
+}
+
+// Shortcut to apply the migrations of providers (e.g. a middleware used without the toolbox)
+func Apply(muxdb *data.MuxDb, providers ...Provider) error {
+	registry := NewRegistry()
+	for _, provider := range providers {
+		if err := registry.Provide(provider); err != nil {
+			return err
+		}
+	}
+	_, err := NewMigrator(muxdb, registry).Up()
+	return err
+}
+
+// Applied returns the versions already applied for a namespace
+func (m *Migrator) Applied(namespace string) ([]int, error) {
+	versions := []int{}
+	err := m.muxdb.Do(func(db *sql.DB) error {
+		if _, err := db.Exec(schemaMigrationsTable); err != nil {
+			return err
+		}
+
+		rows, err := db.Query(m.muxdb.Rebind(`SELECT version FROM schema_migrations WHERE namespace = ? ORDER BY version`), namespace)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				return err
+			}
+			versions = append(versions, version)
+		}
+		return rows.Err()
+	})
+	return versions, err
+}
+
+// Pending returns the migrations not applied yet, in the order they would run
+func (m *Migrator) Pending() ([]Migration, error) {
+	pending := []Migration{}
+	for _, namespace := range m.registry.Namespaces() {
+		applied, err := m.Applied(namespace)
+		if err != nil {
+			return nil, err
+		}
+		done := map[int]bool{}
+		for _, version := range applied {
+			done[version] = true
+		}
+		for _, migration := range m.registry.Migrations(namespace) {
+			if !done[migration.Version] {
+				pending = append(pending, migration)
+			}
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration, each one in its own transaction.
+// Returns the migrations applied, or the ones that would be applied in dry-run mode.
+func (m *Migrator) Up() ([]Migration, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+	if m.config.dryRun {
+		return pending, nil
+	}
+
+	applied := []Migration{}
+	for _, migration := range pending {
+		if err := m.run(migration, migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				m.muxdb.Rebind(`INSERT INTO schema_migrations (namespace, version, name, applied_at) VALUES (?, ?, ?, ?)`),
+				migration.Namespace, migration.Version, migration.Name, time.Now().UnixNano(),
+			)
+			return err
+		}); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// Down rolls back the applied migrations of a namespace with a version above `version`, newest first.
+// Returns the migrations rolled back, or the ones that would be rolled back in dry-run mode.
+func (m *Migrator) Down(namespace string, version int) ([]Migration, error) {
+	applied, err := m.Applied(namespace)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(applied)))
+
+	known := map[int]Migration{}
+	for _, migration := range m.registry.Migrations(namespace) {
+		known[migration.Version] = migration
+	}
+
+	plan := []Migration{}
+	for _, candidate := range applied {
+		if candidate <= version {
+			break
+		}
+		migration, ok := known[candidate]
+		if !ok {
+			return nil, fmt.Errorf("migration %v/%v is applied but not registered", namespace, candidate)
+		}
+		if migration.Down == nil {
+			return nil, fmt.Errorf("migration %v can't be rolled back", migration)
+		}
+		plan = append(plan, migration)
+	}
+	if m.config.dryRun {
+		return plan, nil
+	}
+
+	rolledBack := []Migration{}
+	for _, migration := range plan {
+		if err := m.run(migration, migration.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				m.muxdb.Rebind(`DELETE FROM schema_migrations WHERE namespace = ? AND version = ?`),
+				migration.Namespace, migration.Version,
+			)
+			return err
+		}); err != nil {
+			return rolledBack, err
+		}
+		rolledBack = append(rolledBack, migration)
+	}
+	return rolledBack, nil
+}
+
+func (m *Migrator) run(migration Migration, step Step, record func(tx *sql.Tx) error) error {
+	return m.muxdb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		if err := step(tx, m.muxdb.Dialect()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %v failed: %w", migration, err)
+		}
+		if err := record(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
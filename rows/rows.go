@@ -1,6 +1,7 @@
 package rows
 
 import (
+	"database/sql"
 	"database/sql/driver"
 	"io"
 )
@@ -45,3 +46,31 @@ func GetRowsMap(iterate func(dest []driver.Value) error, opts ...rowOptions) ([]
 	}
 	return rows, nil
 }
+
+// Same as `GetRowsMap` but for the `database/sql` api, the columns are taken from the rows themselves
+func GetSqlRowsMap(sqlRows *sql.Rows) ([]map[string]interface{}, error) {
+	cols, err := sqlRows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	rows := []map[string]interface{}{}
+	for sqlRows.Next() {
+		dest := make([]interface{}, len(cols))
+		pointers := make([]interface{}, len(cols))
+		for i := range dest {
+			pointers[i] = &dest[i]
+		}
+		if err := sqlRows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i := 0; i < len(cols); i++ {
+			row[cols[i]] = dest[i]
+		}
+		rows = append(rows, row)
+	}
+	if err := sqlRows.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -1,17 +1,23 @@
 package sqltoolbox
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"reflect"
 
+	adapterpostgres "github.com/davidroman0O/sql-toolbox/adapters/postgres"
 	adaptersqlite3 "github.com/davidroman0O/sql-toolbox/adapters/sqlite3"
 	"github.com/davidroman0O/sql-toolbox/data"
+	"github.com/davidroman0O/sql-toolbox/migrations"
 )
 
 type Toolbox struct {
 	*data.MuxDb
 	config *initConfig
+	// false in dry-run mode, the middlewares were never initialized
+	started bool
 }
 
 type findConfig struct{}
@@ -40,6 +46,9 @@ func FindMiddleware[T any](t *Toolbox, opts ...findOptions) (*T, error) {
 type initConfig struct {
 	connector         DatabaseConnector
 	middlewareManager *data.MiddlewareManager
+	migrations        []migrations.Migration
+	migrationOptions  []migrations.MigratorOption
+	registry          *migrations.Registry
 }
 
 type initOpts func(*initConfig) error
@@ -51,12 +60,49 @@ func WithSqlite3(opts ...adaptersqlite3.SqliteOption) initOpts {
 	}
 }
 
-func WithMiddleware(middleware data.Middleware) initOpts {
+// Connect to postgres. With `adapterpostgres.DBWithChangeEvents` the changes are received by a `LISTEN` connection,
+// the notifications sent while it reconnects after losing the server are lost.
+func WithPostgres(opts ...adapterpostgres.PostgresOption) initOpts {
+	return func(config *initConfig) error {
+		config.connector = *adapterpostgres.NewPostgresConnector(opts...)
+		return nil
+	}
+}
+
+// Register a middleware, the subscriptions restrict the changes it receives (e.g. `data.OnTable("users", data.Insert)`),
+// otherwise it gets the ones it declared as a `data.Subscriber` or every change.
+func WithMiddleware(middleware data.Middleware, subscriptions ...data.Subscription) initOpts {
 	return func(ic *initConfig) error {
 		if reflect.TypeOf(middleware).Kind() != reflect.Ptr {
 			return fmt.Errorf("middleware must be a pointer to a struct")
 		}
-		ic.middlewareManager.Register(middleware)
+		ic.middlewareManager.Register(middleware, subscriptions...)
+		return nil
+	}
+}
+
+// Migrations of the application, applied after the ones of the middlewares (namespace `app` by default)
+func WithMigrations(ms ...migrations.Migration) initOpts {
+	return func(ic *initConfig) error {
+		ic.migrations = append(ic.migrations, ms...)
+		return nil
+	}
+}
+
+// Tweak how the migrations are applied by `New`, e.g. `migrations.DryRun()` only logs the pending ones.
+// In dry-run mode the middlewares are not started since their tables might not exist, the toolbox only
+// gives access to the database and to its `Migrator`.
+func WithMigrationOptions(opts ...migrations.MigratorOption) initOpts {
+	return func(ic *initConfig) error {
+		ic.migrationOptions = append(ic.migrationOptions, opts...)
+		return nil
+	}
+}
+
+// Receives the errors returned by the middlewares while handling inserts, updates and deletes
+func WithErrorSink(sink data.ErrorSink) initOpts {
+	return func(ic *initConfig) error {
+		ic.middlewareManager.ErrorSink = sink
 		return nil
 	}
 }
@@ -92,22 +138,101 @@ func New(opts ...initOpts) (*Toolbox, error) {
 		}
 		return nil
 	}); err != nil {
-		return nil, err
+		return toolbox.abort(err)
+	}
+
+	// Migrate the tables of the middlewares and the application before using them
+	config.registry = migrations.NewRegistry()
+	for _, middleware := range config.middlewareManager.Middlewares {
+		if provider, ok := middleware.(migrations.Provider); ok {
+			if err := config.registry.Provide(provider); err != nil {
+				return toolbox.abort(err)
+			}
+		}
+	}
+	if err := config.registry.Register(config.migrations...); err != nil {
+		return toolbox.abort(err)
+	}
+
+	migrator := toolbox.Migrator()
+	var plan []migrations.Migration
+	if plan, err = migrator.Up(); err != nil {
+		return toolbox.abort(err)
+	}
+	for _, migration := range plan {
+		slog.Info("migration", slog.String("migration", migration.String()), slog.Bool("dry_run", migrator.DryRun()))
+	}
+	if migrator.DryRun() {
+		return toolbox, nil
 	}
 
 	// Initialize middlewares
 	if err := config.middlewareManager.RunOnInit(toolbox.MuxDb); err != nil {
-		return nil, err
+		return toolbox.abort(err)
 	}
+	toolbox.started = true
 
 	return toolbox, nil
 }
 
+// abort releases what `New` opened before failing with `err`, like the listener of the changes.
+// Unlike `Close` the sqlite file is kept, the failure can be investigated on it.
+func (t *Toolbox) abort(err error) (*Toolbox, error) {
+	t.config.middlewareManager.Stop()
+	if connector, ok := t.config.connector.(adapterpostgres.PostgresConnector); ok {
+		connector.Close()
+	}
+	t.MuxDb.Close()
+	return nil, err
+}
+
+// Migrator over the migrations of the middlewares and the application, e.g. to roll back with `Down`
+func (t *Toolbox) Migrator(opts ...migrations.MigratorOption) *migrations.Migrator {
+	options := append([]migrations.MigratorOption{}, t.config.migrationOptions...)
+	return migrations.NewMigrator(t.MuxDb, t.config.registry, append(options, opts...)...)
+}
+
+// WithTx runs `fn` in a transaction committed when it returns nil and rolled back otherwise.
+// Pass the transaction to `SendTx` or `PushTx` to enqueue work atomically with your own rows.
+// Only `tx` may be used inside `fn`: sqlite has a single connection, held by the transaction until it ends,
+// so `Send`, `Push`, `Query` or anything else going through the `MuxDb` would wait for it forever.
+// The calls of the other goroutines wait for the transaction to end.
+func (t *Toolbox) WithTx(fn func(tx *sql.Tx) error) error {
+	return t.MuxDb.Do(func(db *sql.DB) error {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+
+		committed := false
+		defer func() {
+			if !committed {
+				tx.Rollback()
+			}
+		}()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		committed = true
+		return nil
+	})
+}
+
 func (t *Toolbox) Close() error {
 	if t.config.connector != nil {
+		// Deliver the changes that were already committed
+		t.config.middlewareManager.Stop()
+
 		// Close middlewares
-		if err := t.config.middlewareManager.RunOnClose(); err != nil {
-			return err
+		if t.started {
+			if err := t.config.middlewareManager.RunOnClose(); err != nil {
+				return err
+			}
 		}
 
 		if err := t.config.connector.Close(); err != nil {